@@ -1,37 +1,125 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type Agent struct {
+	// rtt is the round-trip time of the last heartbeat in nanoseconds, it
+	// is accessed atomically, so it is kept 64-bit aligned at the beginning.
+	rtt int64
+
 	conn net.Conn
 	msgr *MessageReader
+	mw   *MessageWriter
 
 	ev    AgentEvent
-	tfs   map[string]Transferer
-	lcons map[string]net.Conn
+	tfs   map[string]*Transferer
+	lcons map[string]*localConn
+	// dialing queues the messages of the transfers whose local connections
+	// are being created, they are bounded by the window of broker.
+	dialing map[string][]Transferable
+	done    chan struct{}
+
+	// nextTID is the last allocated transfer id, only used by broker.
+	nextTID uint64
+	// exposed are the route keys registered by the agent, only used by
+	// broker.
+	exposed []string
+	// goingAway is set by broker when the agent sends GoAwayMessage.
+	goingAway int32
+
+	closing chan struct{}
+	// closeCalled guards closing from being closed twice.
+	closeCalled int32
+	// unanswered is the number of pings sent since the last pong.
+	unanswered int32
 
 	ID string
+	// Group is the agent group to join, it is optional.
+	Group string
+	// TLSConfig is used to connect to broker if it is not nil.
+	TLSConfig *tls.Config
+	// Expose maps the hosts to expose to local addresses, they are
+	// registered to broker after the agent is authenticated.
+	Expose map[string]string
+	// DrainTimeout is the time Close waits for local connections to finish.
+	DrainTimeout time.Duration
+	// Heartbeat checks the peer is alive, it is disabled if the interval is
+	// zero.
+	Heartbeat Heartbeat
 }
 
 type tunnelInfo struct {
 }
 
+// localConn is a connection to local service, data from broker is buffered
+// in recv before it is written to the connection, and data read from the
+// connection is sent within window.
+type localConn struct {
+	net.Conn
+	recv   *StreamBuffer
+	window *Window
+	// packets is used instead of recv and window for udp connections.
+	packets *PacketBuffer
+	// header is written before the data in recv, such as a PROXY protocol
+	// header.
+	header []byte
+}
+
+func (c *localConn) Close() error {
+	if c.packets != nil {
+		c.packets.SetError(io.ErrClosedPipe)
+	} else {
+		c.recv.SetError(io.ErrClosedPipe)
+		c.window.SetError(io.ErrClosedPipe)
+	}
+	return c.Conn.Close()
+}
+
+var (
+	ErrTIDInUse = errors.New("transfer id already in use")
+	// ErrBrokerGoAway is returned by Serve if the broker has sent a
+	// GoAwayMessage before the connection is closed.
+	ErrBrokerGoAway = errors.New("broker has gone away")
+)
+
+const localDialTimeout = time.Second * 10
+
+// dialLocal creates local connections, it is replaced by tests.
+var dialLocal = net.DialTimeout
+
 type AgentEvent struct {
 	GetLocalConn    chan AE_GetLocalConn
+	LocalConnDialed chan AE_LocalConnDialed
 	CloseLocalConn  chan AE_CloseLocalConn
-	DispatchRequest chan DataMessage
+	DispatchRequest chan Transferable
 }
 
 type (
 	AE_GetLocalConn struct {
-		TID    string
-		Host   string
-		Future *Future
+		TID  string
+		Host string
+		// Timeout limits the time to connect, localDialTimeout is used if
+		// it is 0.
+		Timeout time.Duration
+		// ClientAddr is sent in a PROXY protocol header of version
+		// ProxyProtocol if it is not 0.
+		ClientAddr    string
+		ProxyProtocol int
+	}
+	AE_LocalConnDialed struct {
+		AE_GetLocalConn
+		Conn net.Conn
+		Err  error
 	}
 	AE_CloseLocalConn struct {
 		TID, Host string
@@ -41,13 +129,16 @@ type (
 
 func NewAgent(id string) *Agent {
 	a := &Agent{
-		ID:    id,
-		tfs:   make(map[string]Transferer),
-		lcons: make(map[string]net.Conn),
+		ID:      id,
+		tfs:     make(map[string]*Transferer),
+		lcons:   make(map[string]*localConn),
+		dialing: make(map[string][]Transferable),
+		closing: make(chan struct{}),
 	}
 	a.ev.GetLocalConn = make(chan AE_GetLocalConn)
+	a.ev.LocalConnDialed = make(chan AE_LocalConnDialed)
 	a.ev.CloseLocalConn = make(chan AE_CloseLocalConn)
-	a.ev.DispatchRequest = make(chan DataMessage)
+	a.ev.DispatchRequest = make(chan Transferable)
 	return a
 }
 
@@ -59,12 +150,38 @@ func (a *Agent) ReadMessage(timeout time.Duration) (Transferable, error) {
 	return a.msgr.Read()
 }
 
+// SendMessage queues msg to be sent to the peer, see MessageWriter.
 func (a *Agent) SendMessage(msg Transferable) error {
-	_, err := a.conn.Write(msg.Bytes())
-	return err
+	return a.mw.Write(msg)
+}
+
+// SendPacket queues a datagram to be sent to the peer, it is dropped if the
+// connection is congested, see MessageWriter.WritePacket.
+func (a *Agent) SendPacket(msg DataMessage) error {
+	return a.mw.WritePacket(msg)
 }
 
-func (a Agent) String() string {
+func (a *Agent) closeConn() {
+	a.conn.Close()
+	a.mw.Close()
+}
+
+// closeWithMessage sends msg to the peer before closing the connection. It
+// waits at most one second for the queued messages to be written.
+func (a *Agent) closeWithMessage(msg Transferable) {
+	a.SendMessage(msg)
+	a.flushAndClose()
+}
+
+// flushAndClose closes the connection after the queued messages are sent,
+// it waits at most 1 second.
+func (a *Agent) flushAndClose() {
+	a.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	a.mw.Close()
+	a.conn.Close()
+}
+
+func (a *Agent) String() string {
 	id := a.ID
 	if id == "" {
 		id = "unknown"
@@ -72,44 +189,150 @@ func (a Agent) String() string {
 	return id + "@" + a.conn.RemoteAddr().String()
 }
 
+// Connect connects to broker and serves until the connection is broken.
 func (a *Agent) Connect(addr, token string) (err error) {
-	if a.conn, err = net.Dial("tcp", addr); err != nil {
+	if err = a.Dial(addr, token); err != nil {
+		return
+	}
+	defer a.closeConn()
+	return a.Serve()
+}
+
+// Dial connects and authenticates to broker.
+func (a *Agent) Dial(addr, token string) (err error) {
+	if a.TLSConfig != nil {
+		a.conn, err = tls.Dial("tcp", addr, a.TLSConfig)
+	} else {
+		a.conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
 		return
 	}
-	defer a.conn.Close()
 	a.msgr = NewMessageReader(a.conn)
+	a.mw = NewMessageWriter(a.conn)
 
 	if err = a.auth(token); err != nil {
+		a.closeConn()
 		return fmt.Errorf("auth to broker: %s", err)
 	}
+	if len(a.Expose) > 0 {
+		if err = a.register(); err != nil {
+			a.closeConn()
+			return fmt.Errorf("register routes: %s", err)
+		}
+	}
+	return
+}
 
-	log.Info("connect to broker successfully")
+// Serve runs the event loop of agent until the connection to broker is
+// broken or the agent is closed, it returns nil in the latter case. All local
+// connections are closed when Serve returns.
+func (a *Agent) Serve() (err error) {
+	a.done = make(chan struct{})
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- a.recvBrokerMessage()
+	}()
+	go a.keepAlive()
+
+	closing := a.closing
+	var drained <-chan time.Time
+	closed := false
+	for {
+		select {
+		case err = <-recvErr:
+			close(a.done)
+			for tid := range a.lcons {
+				a.eh_CloseLocalConn(AE_CloseLocalConn{TID: tid, Err: err})
+			}
+			if closed {
+				err = nil
+			}
+			return
+		case <-closing:
+			// tell broker to stop routing new transfers to the agent
+			log.Infof("closing, waiting up to %s for %d local connections", a.DrainTimeout, len(a.lcons))
+			a.SendMessage(GoAwayMessage{Reason: "agent is shutting down"})
+			closing, drained = nil, time.After(a.DrainTimeout)
+		case <-drained:
+			log.Infof("%d local connections are not finished in time", len(a.lcons))
+			drained = nil
+			closed = true
+			a.flushAndClose()
+		case e := <-a.ev.GetLocalConn:
+			a.eh_GetLocalConn(e)
+		case e := <-a.ev.LocalConnDialed:
+			a.eh_LocalConnDialed(e)
+		case e := <-a.ev.CloseLocalConn:
+			a.eh_CloseLocalConn(e)
+		case m := <-a.ev.DispatchRequest:
+			a.eh_DispatchRequest(m)
+		}
+		if closing == nil && !closed && len(a.lcons) == 0 && len(a.dialing) == 0 {
+			drained = nil
+			closed = true
+			a.flushAndClose()
+		}
+	}
+}
 
-	var msg Transferable
+func (a *Agent) recvBrokerMessage() error {
+	goAway := false
 	for {
-		msg, err = a.ReadMessage(0)
+		msg, err := a.ReadMessage(0)
 		if err != nil {
-			break
+			if goAway {
+				return ErrBrokerGoAway
+			}
+			return err
+		}
+		if a.handleHeartbeat(msg) {
+			continue
 		}
 		switch m := msg.(type) {
+		case GoAwayMessage:
+			log.Warn("broker is going away: ", m.Reason)
+			goAway = true
 		case TextMessage:
 			log.Info("message from broker: ", m.Content)
-
+		case ErrorMessage:
+			log.Error("error message from broker: ", m.Content)
+		case FirstDataMessage:
+			a.getLocalConn(m)
+			if len(m.Data) > 0 {
+				a.ev.DispatchRequest <- m.DataMessage
+			}
+		case DataMessage, LastDataMessage, WindowUpdateMessage:
+			a.ev.DispatchRequest <- m
 		default:
-
+			log.Info("received an unsupported message from broker")
 		}
 	}
+}
 
-	return
+// sendLastDataMessage tells broker the transfer tid is finished. A non-nil
+// err other than io.EOF is sent as the reason why it is finished.
+func (a *Agent) sendLastDataMessage(tid string, err error) {
+	a.SendMessage(LastDataMessage{
+		DataMessage: DataMessage{TID: tid},
+		Err:         errString(err),
+	})
 }
 
 func (a *Agent) auth(token string) error {
-	err := a.SendMessage(AuthMessage{Token: token, ID: a.ID})
+	err := a.SendMessage(AuthMessage{Token: token, ID: a.ID, Group: a.Group})
 	if err != nil {
 		return err
 	}
+	return a.readReply()
+}
 
+// readReply reads the reply of broker, which is OK or the reason of failure.
+func (a *Agent) readReply() error {
 	msg, err := a.ReadMessage(time.Second * 10)
+	for err == nil && a.handleHeartbeat(msg) {
+		msg, err = a.ReadMessage(time.Second * 10)
+	}
 	if err != nil {
 		return err
 	}
@@ -126,61 +349,242 @@ func (a *Agent) auth(token string) error {
 	return nil
 }
 
-func (a *Agent) getLocalConn(host, tid string) (conn net.Conn, err error) {
-	future := NewFuture()
+func (a *Agent) register() error {
+	if err := a.SendMessage(RegisterMessage{Routes: a.Expose}); err != nil {
+		return err
+	}
+	return a.readReply()
+}
+
+// getLocalConn starts creating the local connection of the transfer started
+// by m, it does not wait for the connection. The messages of the transfer are
+// queued until the connection is created, and broker is told by a
+// LastDataMessage if it fails.
+func (a *Agent) getLocalConn(m FirstDataMessage) {
 	a.ev.GetLocalConn <- AE_GetLocalConn{
-		TID:    tid,
-		Host:   host,
-		Future: future,
+		TID:           m.TID,
+		Host:          m.Host,
+		Timeout:       m.ConnectTimeout,
+		ClientAddr:    m.ClientAddr,
+		ProxyProtocol: m.ProxyProtocol,
 	}
-	val, err := future.Result()
-	if err == nil {
-		conn = val.(net.Conn)
+}
+
+// allocTID returns a transfer id which is not used by any transferer of the
+// agent. IDs increase monotonically during an agent session, so an id is
+// never reused while the broker may still receive messages of an old
+// transfer.
+func (a *Agent) allocTID() string {
+	for {
+		a.nextTID++
+		tid := strconv.FormatUint(a.nextTID, 10)
+		if _, ok := a.tfs[tid]; !ok {
+			return tid
+		}
 	}
-	return
 }
 
+// Close shuts down a serving agent gracefully. Broker is told to stop
+// routing new transfers to the agent, and the connection is closed once the
+// local connections are finished or DrainTimeout expires. Serve returns
+// when it is done.
 func (a *Agent) Close() error {
+	if atomic.CompareAndSwapInt32(&a.closeCalled, 0, 1) {
+		close(a.closing)
+	}
 	return nil
 }
 
+// isGoingAway reports whether the agent has sent GoAwayMessage, it is used
+// by broker.
+func (a *Agent) isGoingAway() bool {
+	return atomic.LoadInt32(&a.goingAway) != 0
+}
+
 func (a *Agent) eh_GetLocalConn(e AE_GetLocalConn) {
-	s := e.TID + e.Host
-	conn, ok := a.lcons[s]
-	if ok {
-		e.Future.Resolve(conn)
+	_, dialing := a.dialing[e.TID]
+	if _, ok := a.lcons[e.TID]; ok || dialing {
+		a.sendLastDataMessage(e.TID, ErrTIDInUse)
 		return
 	}
+	a.dialing[e.TID] = nil
+	// a slow upstream must not block the event loop
+	go a.dialLocalConn(e)
+}
 
-	conn, err := net.Dial("tcp", e.Host)
+func (a *Agent) dialLocalConn(e AE_GetLocalConn) {
+	network, addr := splitNetwork(e.Host)
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = localDialTimeout
+	}
+	conn, err := dialLocal(network, addr, timeout)
 	if err != nil {
 		log.Debugf("fail to create local connection to %s: %s", e.Host, err)
-		e.Future.Reject(err)
+		// broker tells timeouts from other failures by ErrConnectTimeout
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = ErrConnectTimeout
+		}
+	}
+	select {
+	case a.ev.LocalConnDialed <- AE_LocalConnDialed{AE_GetLocalConn: e, Conn: conn, Err: err}:
+	case <-a.done:
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func (a *Agent) eh_LocalConnDialed(e AE_LocalConnDialed) {
+	pending := a.dialing[e.TID]
+	delete(a.dialing, e.TID)
+	if e.Err != nil {
+		a.sendLastDataMessage(e.TID, e.Err)
 		return
 	}
-	a.lcons[s] = conn
-	e.Future.Resolve(conn)
-	log.Debugf("local connection to %s created", e.Host)
 
-	go func() {
-		buf := make([]byte, 16*1024)
-		for serial := 0; ; serial++ {
-			_, err := conn.Read(buf)
-			if err != nil {
-				log.Error("read data from local connection: ", err)
+	conn := e.Conn
+	if network, _ := splitNetwork(e.Host); network == "udp" {
+		lc := &localConn{Conn: conn, packets: NewPacketBuffer(packetQueueSize)}
+		a.lcons[e.TID] = lc
+		go a.readLocalPackets(lc, e.TID, e.Host)
+		go a.writeLocalPackets(lc)
+	} else {
+		lc := &localConn{
+			Conn: conn,
+			recv: NewStreamBuffer(func(n int) {
+				a.SendMessage(WindowUpdateMessage{TID: e.TID, Size: n})
+			}),
+			window: NewWindow(InitialWindowSize),
+		}
+		if e.ProxyProtocol > 0 {
+			lc.header = proxyHeader(e.ProxyProtocol, parseTCPAddr(e.ClientAddr), conn.RemoteAddr())
+		}
+		a.lcons[e.TID] = lc
+		log.Debugf("local connection to %s created", e.Host)
+
+		go a.readLocalConn(lc, e.TID, e.Host)
+		go a.writeLocalConn(lc, e.TID)
+	}
+
+	for _, msg := range pending {
+		a.eh_DispatchRequest(msg)
+	}
+}
+
+// queueDialing queues msg of transfer tid if its local connection is being
+// created, it reports whether msg is queued.
+func (a *Agent) queueDialing(tid string, msg Transferable) bool {
+	pending, ok := a.dialing[tid]
+	if ok {
+		a.dialing[tid] = append(pending, msg)
+	}
+	return ok
+}
+
+// readLocalConn sends the data read from a local connection to broker until
+// the connection is closed, then sends a LastDataMessage with the reason.
+func (a *Agent) readLocalConn(lc *localConn, tid, host string) {
+	var err error
+	buf := make([]byte, 16*1024)
+	for err == nil {
+		var n int
+		n, err = lc.Read(buf)
+		for data := buf[:n]; len(data) > 0; {
+			k, werr := lc.window.Take(len(data))
+			if werr != nil {
+				err = werr
 				break
 			}
+			if werr = a.SendMessage(DataMessage{TID: tid, Data: data[:k]}); werr != nil {
+				err = werr
+				break
+			}
+			data = data[k:]
 		}
-		a.ev.CloseLocalConn <- AE_CloseLocalConn{TID: e.TID, Host: e.Host}
-	}()
+	}
+	a.sendLastDataMessage(tid, err)
+
+	select {
+	case a.ev.CloseLocalConn <- AE_CloseLocalConn{TID: tid, Host: host, Err: err}:
+	case <-a.done:
+	}
+}
+
+// writeLocalConn writes the data received from broker to a local connection,
+// the connection is closed after all data is written.
+func (a *Agent) writeLocalConn(lc *localConn, tid string) {
+	_, err := io.Copy(lc.Conn, io.MultiReader(bytes.NewReader(lc.header), lc.recv))
+	if err == nil {
+		// the request is finished, the response is still read until the
+		// local service closes the connection
+		closeWrite(lc.Conn)
+		return
+	}
+	if err != io.ErrClosedPipe {
+		log.Debugf("write data to local connection: %s", err)
+		a.sendLastDataMessage(tid, err)
+	}
+	lc.Close()
 }
 
-func (a *Agent) eh_CloseLocalConn(tid, host string) {
-	s := tid + host
-	conn, ok := a.lcons[s]
+func (a *Agent) eh_CloseLocalConn(e AE_CloseLocalConn) {
+	lc, ok := a.lcons[e.TID]
 	if !ok {
 		return
 	}
-	conn.Close()
-	delete(a.lcons, s)
+	lc.Close()
+	delete(a.lcons, e.TID)
+	if e.Err != nil && e.Err != io.EOF {
+		log.Debugf("local connection of transfer %s closed: %s", e.TID, e.Err)
+	}
+}
+
+func (a *Agent) eh_DispatchRequest(msg Transferable) {
+	switch m := msg.(type) {
+	case DataMessage:
+		if a.queueDialing(m.TID, m) {
+			return
+		}
+		lc, ok := a.lcons[m.TID]
+		if !ok {
+			return
+		}
+		if lc.packets != nil {
+			lc.packets.Write(m.Data)
+		} else if len(m.Data) > 0 {
+			lc.recv.Write(m.Data)
+		}
+
+	case LastDataMessage:
+		if a.queueDialing(m.TID, m) {
+			return
+		}
+		lc, ok := a.lcons[m.TID]
+		if !ok {
+			return
+		}
+		if lc.packets != nil {
+			// udp transfers are only finished by broker when they expire
+			lc.Close()
+			return
+		}
+		if len(m.Data) > 0 {
+			lc.recv.Write(m.Data)
+		}
+		if m.Err == "" {
+			lc.recv.Close()
+		} else {
+			// the transfer is aborted by broker
+			lc.Close()
+		}
+
+	case WindowUpdateMessage:
+		if a.queueDialing(m.TID, m) {
+			return
+		}
+		if lc, ok := a.lcons[m.TID]; ok && lc.window != nil {
+			lc.window.Add(m.Size)
+		}
+	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectFakeBroker starts an agent connected to a fake broker, and returns
+// the broker side of the connection.
+func connectFakeBroker(t *testing.T) (conn net.Conn, r *MessageReader) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	go NewAgent("test-agent").Connect(lsn.Addr().String(), "test-token")
+
+	conn, err = lsn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	r = NewMessageReader(conn)
+	if _, err = r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(TextMessage{Content: "OK"}.Bytes())
+	return
+}
+
+func TestAgentForwardLocalOutput(t *testing.T) {
+	assert := assert.New(t)
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+	go func() {
+		conn, err := lsn.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	conn, r := connectFakeBroker(t)
+	defer conn.Close()
+	conn.Write(FirstDataMessage{
+		Host:        lsn.Addr().String(),
+		DataMessage: DataMessage{TID: "1"},
+	}.Bytes())
+
+	msg, err := r.Read()
+	assert.Nil(err)
+	assert.Equal(DataMessage{TID: "1", Data: []byte("hello")}, msg)
+
+	msg, err = r.Read()
+	assert.Nil(err)
+	assert.Equal(LastDataMessage{DataMessage: DataMessage{TID: "1"}}, msg)
+}
+
+func TestAgentReportDialError(t *testing.T) {
+	assert := assert.New(t)
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lsn.Addr().String()
+	lsn.Close()
+
+	conn, r := connectFakeBroker(t)
+	defer conn.Close()
+	conn.Write(FirstDataMessage{
+		Host:        addr,
+		DataMessage: DataMessage{TID: "1"},
+	}.Bytes())
+
+	msg, err := r.Read()
+	assert.Nil(err)
+	if assert.IsType(LastDataMessage{}, msg) {
+		assert.Equal("1", msg.(LastDataMessage).TID)
+		assert.NotEmpty(msg.(LastDataMessage).Err)
+	}
+}
+
+func TestAgentSlowDialNotBlockOthers(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	// dials to blackhole.test hang until release is closed
+	started, release := make(chan struct{}), make(chan struct{})
+	dialLocal = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		if addr == "blackhole.test:80" {
+			close(started)
+			<-release
+			return nil, ErrConnectTimeout
+		}
+		return net.DialTimeout(network, addr, timeout)
+	}
+	defer func() {
+		close(release)
+		dialLocal = net.DialTimeout
+	}()
+
+	conn, r := connectFakeBroker(t)
+	defer conn.Close()
+	conn.Write(FirstDataMessage{
+		Host:        "blackhole.test:80",
+		DataMessage: DataMessage{TID: "1", Data: []byte("queued")},
+	}.Bytes())
+	<-started
+	conn.Write(FirstDataMessage{
+		Host:        echo.Addr().String(),
+		DataMessage: DataMessage{TID: "2", Data: []byte("ping")},
+	}.Bytes())
+
+	start := time.Now()
+	msg, err := r.Read()
+	assert.Nil(err)
+	assert.Equal(DataMessage{TID: "2", Data: []byte("ping")}, msg)
+	assert.True(time.Since(start) < time.Second, "transfer is blocked by a slow dial")
+}
+
+func TestAgentReconnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	startBroker := func(lsn net.Listener) (*Broker, func()) {
+		b := &Broker{Credentials: Credentials{
+			"test-agent": {
+				digest: mustParseTokenHash(HashToken("test-token")),
+				Expose: []string{"*.test.host"},
+			},
+		}}
+		b.Init()
+		_, stop := serveTestBrokerOn(t, b, lsn)
+		return b, stop
+	}
+	lsn1, lsn2 := listenLocal(t), listenLocal(t)
+	addr1 := lsn1.Addr().String()
+	b1, stop1 := startBroker(lsn1)
+	b2, stop2 := startBroker(lsn2)
+
+	shutdown, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		runAgent(AgentConf{
+			addrs:     []string{addr1, lsn2.Addr().String()},
+			token:     "test-token",
+			id:        "test-agent",
+			reconnect: true,
+			backoff:   Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 50},
+		}, nil, map[string]string{"app.test.host": echo.Addr().String()}, shutdown)
+		close(finished)
+	}()
+	waitRoute(t, b1, "app.test.host")
+
+	// the agent moves to the next broker when the first one goes away
+	stop1()
+	waitRoute(t, b2, "app.test.host")
+
+	// then keeps retrying until the first broker is restarted
+	stop2()
+	time.Sleep(time.Millisecond * 100)
+	lsn1, err := net.Listen("tcp", addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b3, stop3 := startBroker(lsn1)
+	defer stop3()
+	waitRoute(t, b3, "app.test.host")
+
+	close(shutdown)
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("agent is not closed")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delays between reconnections. The delay starts at Min
+// and doubles after every failed attempt until it reaches Max, a random
+// jitter of at most Jitter*delay is added or subtracted.
+type Backoff struct {
+	Min, Max time.Duration
+	Jitter   float64
+
+	attempt uint
+}
+
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := uint(0); i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	b := Backoff{Min: time.Second, Max: time.Second * 5}
+	assert.Equal(time.Second, b.Next())
+	assert.Equal(time.Second*2, b.Next())
+	assert.Equal(time.Second*4, b.Next())
+	assert.Equal(time.Second*5, b.Next())
+	assert.Equal(time.Second*5, b.Next())
+
+	b.Reset()
+	assert.Equal(time.Second, b.Next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := b.Next()
+		assert.True(t, d >= time.Second/2 && d <= time.Second*3/2, d)
+	}
+}
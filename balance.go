@@ -0,0 +1,85 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+// Strategies to choose an agent of a route.
+const (
+	BalanceRoundRobin  = "round-robin"
+	BalanceLeastActive = "least-active"
+	// BalanceHash chooses agents by the hash of client IP, a client keeps
+	// using the same agent as long as the agent is online.
+	BalanceHash = "hash"
+)
+
+func validBalance(s string) bool {
+	switch s {
+	case BalanceRoundRobin, BalanceLeastActive, BalanceHash:
+		return true
+	}
+	return false
+}
+
+// candidates returns the online agents which can serve route, agents going
+// away are excluded.
+func (b *Broker) candidates(route RouteRecord) (agents []*Agent) {
+	for _, id := range route.AgentIDs {
+		var as []*Agent
+		if len(id) > 1 && id[0] == '@' {
+			as = b.groups[id[1:]]
+		} else {
+			as = b.agents[id]
+		}
+		for _, agent := range as {
+			if !agent.isGoingAway() {
+				agents = append(agents, agent)
+			}
+		}
+	}
+	return
+}
+
+// selectAgent chooses an online agent for a transfer of the route key, it
+// returns nil if no agent of the route is online.
+func (b *Broker) selectAgent(key string, route RouteRecord, clientIP string) *Agent {
+	agents := b.candidates(route)
+	if len(agents) == 0 {
+		return nil
+	}
+
+	balance := route.Balance
+	if balance == "" {
+		balance = b.Balance
+	}
+	switch balance {
+	case BalanceLeastActive:
+		selected := agents[0]
+		for _, agent := range agents[1:] {
+			if len(agent.tfs) < len(selected.tfs) {
+				selected = agent
+			}
+		}
+		return selected
+
+	case BalanceHash:
+		// rendezvous hashing, only the clients of an offline agent are
+		// moved to other agents
+		var selected *Agent
+		var max uint64
+		for _, agent := range agents {
+			h := fnv.New64a()
+			h.Write([]byte(clientIP))
+			h.Write([]byte(agent.ID))
+			if sum := h.Sum64(); selected == nil || sum > max {
+				selected, max = agent, sum
+			}
+		}
+		return selected
+
+	default:
+		i := b.rr[key]
+		b.rr[key]++
+		return agents[i%uint(len(agents))]
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBalanceTestBroker(agents ...*Agent) *Broker {
+	b := &Broker{}
+	b.Init()
+	for _, agent := range agents {
+		b.agents[agent.ID] = append(b.agents[agent.ID], agent)
+		if agent.Group != "" {
+			b.groups[agent.Group] = append(b.groups[agent.Group], agent)
+		}
+	}
+	return b
+}
+
+func newBalanceTestAgent(id, group string) *Agent {
+	agent := NewAgent(id)
+	agent.Group = group
+	agent.conn, _ = net.Pipe()
+	return agent
+}
+
+// remoteConn is a net.Conn with a given remote address.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestCandidates(t *testing.T) {
+	a := newBalanceTestAgent("a", "")
+	b1 := newBalanceTestAgent("b1", "g")
+	b2 := newBalanceTestAgent("b2", "g")
+	broker := newBalanceTestBroker(a, b1, b2)
+
+	route := RouteRecord{AgentIDs: []string{"a", "offline", "@g"}}
+	assert.Equal(t, []*Agent{a, b1, b2}, broker.candidates(route))
+	route = RouteRecord{AgentIDs: []string{"@offline"}}
+	assert.Empty(t, broker.candidates(route))
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	a := newBalanceTestAgent("a", "")
+	b := newBalanceTestAgent("b", "")
+	broker := newBalanceTestBroker(a, b)
+
+	route := RouteRecord{AgentIDs: []string{"a", "b"}, Balance: BalanceRoundRobin}
+	var selected []*Agent
+	for i := 0; i < 4; i++ {
+		selected = append(selected, broker.selectAgent("host", route, ""))
+	}
+	assert.Equal(t, []*Agent{a, b, a, b}, selected)
+}
+
+func TestBalanceLeastActive(t *testing.T) {
+	a := newBalanceTestAgent("a", "")
+	b := newBalanceTestAgent("b", "")
+	a.tfs["1"] = NewTransferer(nil)
+	broker := newBalanceTestBroker(a, b)
+
+	route := RouteRecord{AgentIDs: []string{"a", "b"}, Balance: BalanceLeastActive}
+	assert.Equal(t, b, broker.selectAgent("host", route, ""))
+	b.tfs["1"] = NewTransferer(nil)
+	b.tfs["2"] = NewTransferer(nil)
+	assert.Equal(t, a, broker.selectAgent("host", route, ""))
+}
+
+func TestBalanceHash(t *testing.T) {
+	assert := assert.New(t)
+	agents := []*Agent{
+		newBalanceTestAgent("a", "g"),
+		newBalanceTestAgent("b", "g"),
+		newBalanceTestAgent("c", "g"),
+	}
+	broker := newBalanceTestBroker(agents...)
+	route := RouteRecord{AgentIDs: []string{"@g"}, Balance: BalanceHash}
+
+	clients := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+	selected := make(map[string]*Agent)
+	for _, ip := range clients {
+		selected[ip] = broker.selectAgent("host", route, ip)
+		assert.Equal(selected[ip], broker.selectAgent("host", route, ip))
+	}
+
+	// only the clients of the removed agent are moved
+	removed := selected[clients[0]]
+	broker.removeAgent(removed)
+	for _, ip := range clients {
+		agent := broker.selectAgent("host", route, ip)
+		assert.NotEqual(removed, agent)
+		if selected[ip] != removed {
+			assert.Equal(selected[ip], agent)
+		}
+	}
+
+	// the clients are moved back when the agent reconnects, even if it is
+	// from another port
+	reconnected := newBalanceTestAgent(removed.ID, "g")
+	reconnected.conn = remoteConn{reconnected.conn, &net.TCPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 40000}}
+	broker.agents[reconnected.ID] = append(broker.agents[reconnected.ID], reconnected)
+	broker.groups["g"] = append(broker.groups["g"], reconnected)
+	for _, ip := range clients {
+		agent := broker.selectAgent("host", route, ip)
+		if selected[ip] == removed {
+			assert.Equal(reconnected, agent)
+		} else {
+			assert.Equal(selected[ip], agent)
+		}
+	}
+}
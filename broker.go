@@ -2,90 +2,274 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type (
 	Broker struct {
-		route  Route
-		agents map[string]*Agent
-		ev     BrokerEvent
-		done   <-chan struct{}
+		route Route
+		// exposed are the routes registered by online agents, route has
+		// priority over them.
+		exposed Route
+		agents  map[string][]*Agent
+		groups  map[string][]*Agent
+		ev      BrokerEvent
+		done    <-chan struct{}
+		// rr is the round-robin counter of each routed host.
+		rr map[string]uint
 
-		Token string
+		// Balance is the default strategy to choose an agent for a route
+		// served by multiple agents.
+		Balance string
+
+		// DuplicateID decides what to do when an agent comes online with
+		// the id of an online agent, see DupReject, DupReplace and
+		// DupBalance.
+		DuplicateID string
+
+		// Token is shared by all agents, it is not used if Credentials is
+		// not nil.
+		Token       string
+		Credentials Credentials
+		// TLSConfig is used by the listener of agents if it is not nil.
+		TLSConfig *tls.Config
+		// HTTPSConfig is used by the HTTPS service.
+		HTTPSConfig *tls.Config
+		// TCPTunnels maps listening addresses to the routes of raw tcp
+		// tunnels, see ParseTunnel.
+		TCPTunnels map[string]RouteRecord
+		// UDPTunnels maps listening addresses to the routes of udp tunnels,
+		// a session is closed if it is idle for UDPIdleTimeout.
+		UDPTunnels     map[string]RouteRecord
+		UDPIdleTimeout time.Duration
+		// AcceptProxyProtocol requires a PROXY protocol header on the http,
+		// https and tcp tunnel listeners, it is used behind a load balancer.
+		AcceptProxyProtocol bool
+
+		// ShutdownGrace is the time to wait for in-flight transfers when
+		// the broker is shutting down.
+		ShutdownGrace time.Duration
+
+		// ErrorPage is the template of HTML error pages of routes without
+		// their own, see LoadErrorPage.
+		ErrorPage *template.Template
+
+		// Heartbeat is used to detect dead agents, agents missing too many
+		// pings are considered offline.
+		Heartbeat Heartbeat
+
+		// tunnels and udpTunnels are the listeners of TCPTunnels and
+		// UDPTunnels.
+		tunnels    map[net.Listener]RouteRecord
+		udpTunnels map[net.PacketConn]RouteRecord
+		httpConns  connSet
+		// shutdown is not nil once the broker starts shutting down.
+		shutdown *shutdownStats
+		// transfers is the number of created transferers.
+		transfers int
 	}
 )
 
+// Policies of duplicate agent id.
+const (
+	// DupReject rejects the new agent.
+	DupReject = "reject"
+	// DupReplace closes the old agent, the new one takes its place.
+	DupReplace = "replace"
+	// DupBalance keeps both agents, transfers are balanced between them.
+	DupBalance = "balance"
+)
+
 type BrokerEvent struct {
 	AgentOnline      chan *Agent
 	AgentOffline     chan *Agent
+	AgentGoAway      chan *Agent
 	CreateTransferer chan BrokerEvCreateTransferer
+	MatchRoute       chan BrokerEvMatchRoute
+	ReplaceRoute     chan Route
+	RegisterRoute    chan BEvRegisterRoute
 	DispatchRequest  chan BEvDispatchMessage
 	DispatchResponse chan BEvDispatchMessage
 }
 
 type BrokerEvCreateTransferer struct {
-	Host   string
-	future *Future
+	Host, Path string
+	// Route is used instead of matching Host and Path if it is not nil.
+	Route *RouteRecord
+	// Packet creates a transferer of datagrams, see Transferer.Packets.
+	Packet bool
+	// ClientAddr is the address of the client, its IP is used to choose
+	// an agent by BalanceHash.
+	ClientAddr string
+	future     *Future
+}
+
+type BrokerEvMatchRoute struct {
+	Host, Path string
+	future     *Future
+}
+
+type BEvRegisterRoute struct {
+	Agent  *Agent
+	Routes map[string]string
 }
 
 type BEvDispatchMessage struct {
 	Agent *Agent
-	Msg   DataMessage
+	Msg   Transferable
+	// Packet sends Msg by Agent.SendPacket, Msg must be a DataMessage.
+	Packet bool
 }
 
 func (e *BrokerEvent) Init() {
 	e.AgentOnline = make(chan *Agent)
 	e.AgentOffline = make(chan *Agent)
+	e.AgentGoAway = make(chan *Agent)
 	e.CreateTransferer = make(chan BrokerEvCreateTransferer)
+	e.MatchRoute = make(chan BrokerEvMatchRoute)
+	e.ReplaceRoute = make(chan Route)
+	e.RegisterRoute = make(chan BEvRegisterRoute)
 	e.DispatchRequest = make(chan BEvDispatchMessage)
 	e.DispatchResponse = make(chan BEvDispatchMessage)
 }
 
 func (b *Broker) Init() {
-	b.agents = make(map[string]*Agent)
+	b.exposed = make(Route)
+	b.agents = make(map[string][]*Agent)
+	b.groups = make(map[string][]*Agent)
+	b.rr = make(map[string]uint)
+	b.httpConns.conns = make(map[net.Conn]connState)
 	b.ev.Init()
 }
 
-func (b *Broker) Serve(addr, httpAddr string) (err error) {
+// Serve starts the broker, the HTTPS service is started only if httpsAddr is
+// not empty, and HTTPSConfig must be set in this case.
+func (b *Broker) Serve(addr, httpAddr, httpsAddr string) (err error) {
 	agentListener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("start broker: %s", err)
 	}
 
-	httpListener, err := net.Listen("tcp", httpAddr)
+	httpListener, err := b.listenPublic(httpAddr)
 	if err != nil {
 		return fmt.Errorf("start http service: %s", err)
 	}
+	httpListeners := []net.Listener{httpListener}
+
+	if httpsAddr != "" {
+		httpsListener, err := b.listenPublic(httpsAddr)
+		if err != nil {
+			return fmt.Errorf("start https service: %s", err)
+		}
+		log.Info("https service listen on ", httpsListener.Addr())
+		httpListeners = append(httpListeners, tls.NewListener(httpsListener, b.HTTPSConfig))
+	}
 
+	b.tunnels = make(map[net.Listener]RouteRecord)
+	for addr, route := range b.TCPTunnels {
+		lsn, err := b.listenPublic(addr)
+		if err != nil {
+			return fmt.Errorf("start tcp tunnel: %s", err)
+		}
+		log.Infof("tcp tunnel listen on %s => %s[%s]", lsn.Addr(), strings.Join(route.AgentIDs, ","), route.Host)
+		b.tunnels[lsn] = route
+	}
+
+	b.udpTunnels = make(map[net.PacketConn]RouteRecord)
+	for addr, route := range b.UDPTunnels {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("start udp tunnel: %s", err)
+		}
+		log.Infof("udp tunnel listen on %s => %s[%s]", pc.LocalAddr(), strings.Join(route.AgentIDs, ","), route.Host)
+		b.udpTunnels[pc] = route
+	}
+
+	return b.serve(agentListener, httpListeners...)
+}
+
+// listenPublic listens on a tcp address for clients, the connections start
+// with PROXY protocol headers if AcceptProxyProtocol is set.
+func (b *Broker) listenPublic(addr string) (net.Listener, error) {
+	lsn, err := net.Listen("tcp", addr)
+	if err != nil || !b.AcceptProxyProtocol {
+		return lsn, err
+	}
+	return proxyListener{lsn}, nil
+}
+
+func (b *Broker) serve(agentListener net.Listener, httpListeners ...net.Listener) (err error) {
+	if b.TLSConfig != nil {
+		agentListener = tls.NewListener(agentListener, b.TLSConfig)
+	}
 	go b.acceptAgent(agentListener)
-	go b.acceptHTTPRequest(httpListener)
+	for _, lsn := range httpListeners {
+		go b.acceptHTTPRequest(lsn)
+	}
+	for lsn, route := range b.tunnels {
+		go b.acceptTCP(lsn, route)
+	}
+	for pc, route := range b.udpTunnels {
+		go b.serveUDP(pc, route)
+	}
 
 	log.Info("hrt broker listen on ", agentListener.Addr())
 
+	done := b.done
+	var grace <-chan time.Time
 	for {
 		select {
-		case <-b.done:
+		case <-done:
 			agentListener.Close()
-			httpListener.Close()
+			for _, lsn := range httpListeners {
+				lsn.Close()
+			}
+			for lsn := range b.tunnels {
+				lsn.Close()
+			}
+			for pc := range b.udpTunnels {
+				pc.Close()
+			}
+			done = nil
+			grace = b.startShutdown()
+		case <-grace:
+			b.stop()
 			return
 		case agent := <-b.ev.AgentOnline:
 			b.eh_AgentOnline(agent)
 		case agent := <-b.ev.AgentOffline:
 			b.eh_AgentOffline(agent)
+		case agent := <-b.ev.AgentGoAway:
+			b.eh_AgentGoAway(agent)
 		case e := <-b.ev.CreateTransferer:
 			b.eh_CreateTransferer(e)
+		case e := <-b.ev.MatchRoute:
+			b.eh_MatchRoute(e)
+		case route := <-b.ev.ReplaceRoute:
+			b.eh_ReplaceRoute(route)
+		case e := <-b.ev.RegisterRoute:
+			b.eh_RegisterRoute(e)
 		case e := <-b.ev.DispatchRequest:
 			b.eh_DispatchRequest(e)
 		case e := <-b.ev.DispatchResponse:
 			b.eh_DispatchResponse(e)
 		}
+		if b.shutdown != nil && b.inflight() == 0 {
+			b.stop()
+			return
+		}
 	}
 }
 
@@ -95,10 +279,10 @@ func (b *Broker) acceptAgent(lsn net.Listener) {
 		if err != nil {
 			break
 		}
-		agent := &Agent{
-			conn: conn,
-			msgr: NewMessageReader(conn),
-		}
+		agent := NewAgent("")
+		agent.conn = conn
+		agent.msgr = NewMessageReader(conn)
+		agent.mw = NewMessageWriter(conn)
 		go b.auth(agent)
 	}
 }
@@ -108,7 +292,7 @@ func (b *Broker) auth(agent *Agent) {
 	defer func() {
 		if err != nil {
 			log.Errorf("auth agent %s: %s", agent, err)
-			agent.conn.Close()
+			agent.closeWithMessage(ErrorMessage{Content: err.Error()})
 		}
 	}()
 
@@ -122,24 +306,47 @@ func (b *Broker) auth(agent *Agent) {
 		err = errors.New("received a non-auth message")
 		return
 	}
-	if agent.ID = m.ID; agent.ID == "" {
-		err = errors.New("id is empty")
+
+	// a verified client certificate authenticates the agent, its common
+	// name is used as the agent id
+	cn, ok, err := peerCommonName(agent.conn)
+	if err != nil {
 		return
 	}
-	if m.Token != b.Token {
-		err = errors.New("token is not correct")
-		return
+	if ok {
+		if m.ID != "" && m.ID != cn {
+			err = fmt.Errorf("id %q does not match client certificate %q", m.ID, cn)
+			return
+		}
+		agent.ID = cn
+	} else {
+		if agent.ID = m.ID; agent.ID == "" {
+			err = errors.New("id is empty")
+			return
+		}
+		if !b.verifyToken(agent.ID, m.Token) {
+			err = errors.New("token is not correct")
+			return
+		}
 	}
 
-	err = agent.SendMessage(TextMessage{Content: "OK"})
-	if err != nil {
-		err = fmt.Errorf("send OK message: %s", err)
-		return
+	if agent.Group = m.Group; agent.Group != "" && b.Credentials != nil {
+		if !b.Credentials.InGroup(agent.ID, agent.Group) {
+			err = fmt.Errorf("agent is not allowed to join group %s", agent.Group)
+			return
+		}
 	}
 
 	b.ev.AgentOnline <- agent
 }
 
+func (b *Broker) verifyToken(id, token string) bool {
+	if b.Credentials != nil {
+		return b.Credentials.Verify(id, token)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.Token)) == 1
+}
+
 func (b *Broker) recvAgentMessage(agent *Agent) {
 	defer func() {
 		b.ev.AgentOffline <- agent
@@ -150,12 +357,20 @@ func (b *Broker) recvAgentMessage(agent *Agent) {
 			log.Errorf("read message from %s: %s", agent, err)
 			return
 		}
+		if agent.handleHeartbeat(msg) {
+			continue
+		}
 		switch m := msg.(type) {
-		case DataMessage:
+		case DataMessage, LastDataMessage, WindowUpdateMessage:
 			b.ev.DispatchResponse <- BEvDispatchMessage{
 				Msg:   m,
 				Agent: agent,
 			}
+		case RegisterMessage:
+			b.ev.RegisterRoute <- BEvRegisterRoute{Agent: agent, Routes: m.Routes}
+		case GoAwayMessage:
+			log.Infof("agent %s is going away: %s", agent, m.Reason)
+			b.ev.AgentGoAway <- agent
 		case TextMessage:
 			log.Debugf("text message from %s: %s", agent, m.Content)
 		case ErrorMessage:
@@ -168,64 +383,363 @@ func (b *Broker) recvAgentMessage(agent *Agent) {
 }
 
 func (b *Broker) eh_AgentOnline(agent *Agent) {
+	if b.shutdown != nil {
+		go agent.closeWithMessage(ErrorMessage{Content: "broker is shutting down"})
+		return
+	}
+	// agents going away are draining, they do not hold their ids
+	var olds []*Agent
+	for _, old := range b.agents[agent.ID] {
+		if !old.isGoingAway() {
+			olds = append(olds, old)
+		}
+	}
+	if len(olds) > 0 {
+		switch b.DuplicateID {
+		case DupReplace:
+			for _, old := range olds {
+				log.Infof("agent %s is replaced by %s", old, agent)
+				go old.closeWithMessage(ErrorMessage{
+					Content: "replaced by a new connection from " + agent.conn.RemoteAddr().String(),
+				})
+				removeFrom(b.agents, agent.ID, old)
+			}
+		case DupBalance:
+			log.Infof("agent %s joins %d online agents with the same id", agent, len(olds))
+		default:
+			log.Infof("agent %s is rejected since the id is online", agent)
+			go agent.closeWithMessage(ErrorMessage{
+				Content: fmt.Sprintf("agent id %s is already online", agent.ID),
+			})
+			return
+		}
+	}
+
+	if err := agent.SendMessage(TextMessage{Content: "OK"}); err != nil {
+		log.Errorf("send OK message to %s: %s", agent, err)
+		agent.closeConn()
+		return
+	}
 	log.Infof("agent %s online", agent)
-	b.agents[agent.ID] = agent
+	b.agents[agent.ID] = append(b.agents[agent.ID], agent)
+	if agent.Group != "" {
+		b.groups[agent.Group] = append(b.groups[agent.Group], agent)
+	}
 	go b.recvAgentMessage(agent)
+	agent.Heartbeat = b.Heartbeat
+	go agent.keepAlive()
 }
 
 func (b *Broker) eh_AgentOffline(agent *Agent) {
-	log.Infof("agent %s offline", agent)
-	agent.conn.Close()
-	delete(b.agents, agent.ID)
+	log.Infof("agent %s offline, last rtt %s", agent, agent.RTT())
+	agent.closeConn()
+	b.removeAgent(agent)
+	b.unregisterRoute(agent)
+	for _, tf := range agent.tfs {
+		tf.SetError(HErrAgentNotOnline)
+	}
 }
 
-func (b *Broker) eh_DispatchRequest(e BEvDispatchMessage) {
+// eh_AgentGoAway stops routing new transfers to agent, the transfers in
+// progress are kept until the agent goes offline.
+func (b *Broker) eh_AgentGoAway(agent *Agent) {
+	if !b.isOnline(agent) || agent.isGoingAway() {
+		return
+	}
+	atomic.StoreInt32(&agent.goingAway, 1)
+	b.unregisterRoute(agent)
+	// keep-alive connections would hold the local connections of agent
+	b.httpConns.closeIdle(agent)
+}
+
+// removeAgent removes agent from online agents, other agents with the same
+// id are kept.
+func (b *Broker) removeAgent(agent *Agent) {
+	removeFrom(b.agents, agent.ID, agent)
+	if agent.Group != "" {
+		removeFrom(b.groups, agent.Group, agent)
+	}
+}
 
+func removeFrom(m map[string][]*Agent, key string, agent *Agent) {
+	agents := m[key]
+	for i, a := range agents {
+		if a == agent {
+			agents = append(agents[:i:i], agents[i+1:]...)
+			break
+		}
+	}
+	if len(agents) == 0 {
+		delete(m, key)
+	} else {
+		m[key] = agents
+	}
+}
+
+func (b *Broker) isOnline(agent *Agent) bool {
+	for _, a := range b.agents[agent.ID] {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Broker) eh_DispatchRequest(e BEvDispatchMessage) {
+	// the response of a finished request may still be sent by the agent,
+	// unless the transfer is aborted
+	if m, ok := e.Msg.(LastDataMessage); ok && m.Err != "" {
+		delete(e.Agent.tfs, m.TID)
+	}
+	if !b.isOnline(e.Agent) {
+		return
+	}
+	var err error
+	if e.Packet {
+		err = e.Agent.SendPacket(e.Msg.(DataMessage))
+	} else {
+		err = e.Agent.SendMessage(e.Msg)
+	}
+	if err != nil {
+		log.Errorf("send message to %s: %s", e.Agent, err)
+	}
 }
 
 func (b *Broker) eh_DispatchResponse(e BEvDispatchMessage) {
-	tf, ok := e.Agent.tfs[e.Msg.TID]
-	if !ok {
+	switch m := e.Msg.(type) {
+	case DataMessage:
+		tf, ok := e.Agent.tfs[m.TID]
+		if !ok {
+			return
+		}
+		if err := tf.receive(m.Data); err != nil {
+			log.Errorf("receive data of transfer %s from %s: %s", m.TID, e.Agent, err)
+		}
+
+	case WindowUpdateMessage:
+		if tf, ok := e.Agent.tfs[m.TID]; ok {
+			tf.Window.Add(m.Size)
+		}
+
+	case LastDataMessage:
+		tf, ok := e.Agent.tfs[m.TID]
+		if !ok {
+			return
+		}
+		err := remoteError(m.Err)
+		if len(m.Data) > 0 {
+			if rerr := tf.receive(m.Data); rerr != nil {
+				log.Errorf("receive data of transfer %s from %s: %s", m.TID, e.Agent, rerr)
+				err = rerr
+			}
+		}
+		tf.finish(err)
+		delete(e.Agent.tfs, m.TID)
+	}
+}
+
+func (b *Broker) eh_ReplaceRoute(route Route) {
+	b.route = route
+	log.Infof("route replaced, %d records", len(route))
+}
+
+// eh_RegisterRoute adds the routes exposed by an agent. Either all routes are
+// added or none of them, the agent is replied with OK or the reason.
+func (b *Broker) eh_RegisterRoute(e BEvRegisterRoute) {
+	if !b.isOnline(e.Agent) {
+		return
+	}
+	records, err := b.checkExposedRoute(e.Agent, e.Routes)
+	if err != nil {
+		log.Errorf("register routes of %s: %s", e.Agent, err)
+		// the agent is offline before it is told, so it can connect again
+		// with the same id at once
+		b.removeAgent(e.Agent)
+		go e.Agent.closeWithMessage(ErrorMessage{Content: err.Error()})
 		return
 	}
-	tf.Response.Write(e.Msg.Data)
+	for key, record := range records {
+		b.exposed[key] = record
+		e.Agent.exposed = append(e.Agent.exposed, key)
+		log.Infof("agent %s exposes %s => %s", e.Agent, key, record.Host)
+	}
+	if err := e.Agent.SendMessage(TextMessage{Content: "OK"}); err != nil {
+		// the agent is not told the routes are registered, so they are
+		// removed with the agent
+		log.Errorf("send OK message to %s: %s", e.Agent, err)
+		b.unregisterRoute(e.Agent)
+		b.removeAgent(e.Agent)
+		e.Agent.closeConn()
+	}
 }
 
-func (b *Broker) eh_CreateTransferer(e BrokerEvCreateTransferer) {
-	route, ok := b.route[e.Host]
+func (b *Broker) checkExposedRoute(agent *Agent, routes map[string]string) (records Route, err error) {
+	if b.Credentials == nil {
+		return nil, errors.New("broker does not allow agents to expose routes")
+	}
+	records = make(Route)
+	for host, addr := range routes {
+		h, path := splitRouteKey(host)
+		if h == "" {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q of %s", addr, host)
+		}
+		if !b.Credentials.CanExpose(agent.ID, h) {
+			return nil, fmt.Errorf("agent is not allowed to expose %s", host)
+		}
+		key := routeKey(h, path)
+		if _, ok := b.route[key]; ok {
+			return nil, fmt.Errorf("%s is already routed by the route file", host)
+		}
+		if old, ok := b.exposed[key]; ok && old.AgentIDs[0] != agent.ID {
+			return nil, fmt.Errorf("%s is already exposed by agent %s", host, old.AgentIDs[0])
+		}
+		records[key] = RouteRecord{AgentIDs: []string{agent.ID}, Host: addr}
+	}
+	return
+}
+
+// unregisterRoute removes the routes exposed by agent, unless they are also
+// exposed by another online agent with the same id.
+func (b *Broker) unregisterRoute(agent *Agent) {
+	for _, key := range agent.exposed {
+		if b.isExposedByOthers(agent, key) {
+			continue
+		}
+		delete(b.exposed, key)
+		log.Infof("route %s of agent %s is removed", key, agent)
+	}
+	agent.exposed = nil
+}
+
+func (b *Broker) isExposedByOthers(agent *Agent, key string) bool {
+	for _, a := range b.agents[agent.ID] {
+		if a == agent {
+			continue
+		}
+		for _, k := range a.exposed {
+			if k == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchRoute matches the route file first, then the routes exposed by
+// agents.
+func (b *Broker) matchRoute(host, path string) (RouteRecord, bool) {
+	if route, ok := b.route.Match(host, path); ok {
+		return route, true
+	}
+	return b.exposed.Match(host, path)
+}
+
+func (b *Broker) eh_MatchRoute(e BrokerEvMatchRoute) {
+	route, ok := b.matchRoute(e.Host, e.Path)
 	if !ok {
 		e.future.Reject(HErrNoRouteRecort)
 		return
 	}
+	e.future.Resolve(route)
+}
 
-	agent, ok := b.agents[route.AgentID]
-	if !ok {
+func (b *Broker) eh_CreateTransferer(e BrokerEvCreateTransferer) {
+	if b.shutdown != nil {
+		e.future.Reject(HErrShuttingDown)
+		return
+	}
+	var route RouteRecord
+	if e.Route != nil {
+		route = *e.Route
+	} else {
+		var ok bool
+		if route, ok = b.matchRoute(e.Host, e.Path); !ok {
+			e.future.Reject(HErrNoRouteRecort)
+			return
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(e.ClientAddr)
+	if err != nil {
+		clientIP = e.ClientAddr
+	}
+	agent := b.selectAgent(route.Key, route, clientIP)
+	if agent == nil {
 		e.future.Reject(HErrAgentNotOnline)
 		return
 	}
 
-	tid := strconv.FormatUint(114514, 10)
-	tf := Transferer{
-		Request:  NewBlockedBuffer(),
-		Response: NewBlockedBuffer(),
+	b.transfers++
+	tid := agent.allocTID()
+	tf := NewTransferer(func(n int) {
+		agent.SendMessage(WindowUpdateMessage{TID: tid, Size: n})
+	})
+	tf.TID = tid
+	tf.Route = route
+	tf.agent = agent
+	tf.clientAddr = e.ClientAddr
+	tf.onAbort = func() {
+		b.ev.DispatchRequest <- BEvDispatchMessage{
+			Agent: agent,
+			Msg: LastDataMessage{
+				DataMessage: DataMessage{TID: tid},
+				Err:         errString(io.ErrClosedPipe),
+			},
+		}
 	}
 	agent.tfs[tid] = tf
-	e.future.Resolve(&tf)
+	if e.Packet {
+		tf.Packets = NewPacketBuffer(packetQueueSize)
+		e.future.Resolve(tf)
+		go b.forwardPackets(agent, "udp://"+route.Host, tf)
+		return
+	}
+	if d := route.Timeouts.Idle; d > 0 {
+		tf.watchIdle(time.Duration(d))
+	}
+	e.future.Resolve(tf)
 
-	go func() {
-		buf := make([]byte, 16*1024)
-		for serial := 0; ; serial++ {
-			n, err := tf.Request.Read(buf)
-			if err != nil {
-				tf.Request.SetError(err)
+	go b.forwardRequest(agent, route.Host, tf)
+}
+
+// forwardRequest reads the request data written to tf and dispatches it to
+// the agent. A FirstDataMessage is sent first to tell the agent where to
+// connect, data is sent within the window of tf, and a LastDataMessage is
+// sent when tf is closed.
+func (b *Broker) forwardRequest(agent *Agent, host string, tf *Transferer) {
+	dispatch := func(msg Transferable) {
+		b.ev.DispatchRequest <- BEvDispatchMessage{Agent: agent, Msg: msg}
+	}
+	dispatch(FirstDataMessage{
+		DataMessage:    DataMessage{TID: tf.TID},
+		Host:           host,
+		ConnectTimeout: time.Duration(tf.Route.Timeouts.Connect),
+		ClientAddr:     tf.clientAddr,
+		ProxyProtocol:  tf.Route.ProxyProtocol,
+	})
+
+	var err error
+	buf := make([]byte, 16*1024)
+	for err == nil {
+		var n int
+		n, err = tf.Request.Read(buf)
+		for data := buf[:n]; len(data) > 0; {
+			k, werr := tf.Window.Take(len(data))
+			if werr != nil {
+				err = werr
 				break
 			}
-			agent.SendMessage(DataMessage{
-				TID:  tid,
-				Data: buf[:n],
+			dispatch(DataMessage{
+				TID:  tf.TID,
+				Data: append([]byte(nil), data[:k]...),
 			})
+			data = data[k:]
 		}
-	}()
+	}
+	dispatch(LastDataMessage{DataMessage: DataMessage{TID: tf.TID}, Err: errString(err)})
 }
 
 func (b *Broker) acceptHTTPRequest(lsn net.Listener) {
@@ -239,16 +753,26 @@ func (b *Broker) acceptHTTPRequest(lsn net.Listener) {
 }
 
 func (b *Broker) handleHTTPRequest(conn net.Conn) {
+	if !b.httpConns.add(conn) {
+		conn.Close()
+		return
+	}
+	defer b.httpConns.remove(conn)
+
 	var tunnel io.ReadWriteCloser
 	var respReader *bufio.Reader
 	var req *http.Request
 	var resp *http.Response
 	var err error
+	var ectx ErrorContext
 	reqReader := bufio.NewReader(conn)
 
 	defer func() {
 		if he, ok := err.(HTTPError); ok {
-			he.Write(bufio.NewWriter(conn))
+			he.Write(bufio.NewWriter(conn), ectx)
+		}
+		if tunnel != nil {
+			tunnel.Close()
 		}
 		conn.Close()
 	}()
@@ -257,34 +781,269 @@ func (b *Broker) handleHTTPRequest(conn net.Conn) {
 	if err != nil {
 		return
 	}
+	ectx = b.errorContext(req, nil, nil)
 
+	clientAddr := conn.RemoteAddr().String()
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	tf, err := b.CreateTransferer(req.Host, req.URL.Path, clientAddr)
+	if err != nil {
+		return
+	}
+	tunnel = tf
+	respReader = bufio.NewReader(tunnel)
+	// route is the record of the current request, it may be newer than
+	// tf.Route if the route is reloaded
+	route := tf.Route
+
+	proto := "http"
+	if _, ok := conn.(*tls.Conn); ok {
+		proto = "https"
+	}
+loop:
 	for {
-		// FIXME: race condition
-		req.Host = b.route[req.Host].Host
+		ectx = b.errorContext(req, &route, tf.agent)
+		if err = route.Check(req); err != nil {
+			break
+		}
+		upgrade := isUpgrade(req)
+		removeHopHeaders(req.Header, upgrade)
+		setForwardedHeaders(req, clientIP, proto, route.TrustForwarded)
+		req.Host = route.Host
+		route.StripPath(req.URL)
+		route.RequestHeaders.Apply(req.Header)
+		if max := route.MaxBodySize; max > 0 {
+			if req.ContentLength > max {
+				err = HErrRequestTooLarge
+				break
+			}
+			if req.ContentLength < 0 {
+				req.Body = &bodyLimiter{ReadCloser: req.Body, n: max, tf: tf}
+			}
+		}
+
+		// the request is written while the response is read, so a response
+		// sent before the whole body is read, including interim responses
+		// such as 100 Continue, is not blocked by the body
+		reqDone := make(chan error, 1)
+		go func(req *http.Request, tunnel io.Writer) {
+			reqDone <- req.Write(tunnel)
+		}(req, tunnel)
 
-		req.Write(tunnel)
-		resp, err = http.ReadResponse(respReader, req)
+		stopFirstByte := func() bool { return false }
+		if d := route.Timeouts.FirstByte; d > 0 {
+			stopFirstByte = tf.watchFirstByte(time.Duration(d))
+		}
+		resp, err = readFinalResponse(respReader, req, conn)
+		stopFirstByte()
 		if err != nil {
+			err = gatewayError(err)
+			break
+		}
+		switching := resp.StatusCode == http.StatusSwitchingProtocols && upgrade
+		removeHopHeaders(resp.Header, switching)
+		route.ResponseHeaders.Apply(resp.Header)
+		if switching {
+			// the connection is handed over to the upgraded protocol
+			if err = resp.Write(conn); err == nil {
+				if err = <-reqDone; err == nil {
+					pipeFrom(conn, reqReader, tf, respReader)
+				}
+			}
+			break
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
 			break
 		}
-		resp.Write(conn)
+		select {
+		case err = <-reqDone:
+			if err != nil {
+				break loop
+			}
+		default:
+			// the upstream responded without reading the whole request,
+			// the rest of it can not be skipped
+			break loop
+		}
 
+		// idle connections are closed when the broker is shutting down or
+		// the agent is going away
+		if !b.httpConns.setIdle(conn, true, tf.agent) {
+			break
+		}
 		req, err = http.ReadRequest(reqReader)
-		if err != nil {
+		if err != nil || !b.httpConns.setIdle(conn, false, tf.agent) {
+			break
+		}
+		ectx = b.errorContext(req, nil, nil)
+
+		// the request may be served by another route, or by a reloaded
+		// record of the same route
+		if route, err = b.MatchRoute(req.Host, req.URL.Path); err != nil {
 			break
 		}
+		// the upstream may have closed the connection since the last response
+		if !route.sameUpstream(tf.Route) || tf.Response.Err() != nil {
+			tunnel.Close()
+			if tf, err = b.CreateTransferer(req.Host, req.URL.Path, clientAddr); err != nil {
+				tunnel = nil
+				break
+			}
+			tunnel = tf
+			respReader = bufio.NewReader(tunnel)
+			route = tf.Route
+		}
+	}
+}
+
+// readFinalResponse reads the response of req, interim responses other
+// than 101 Switching Protocols are written to conn.
+func readFinalResponse(rd *bufio.Reader, req *http.Request, conn io.Writer) (resp *http.Response, err error) {
+	for {
+		if resp, err = http.ReadResponse(rd, req); err != nil {
+			return
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return
+		}
+		if err = resp.Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+// errorContext returns the context of the errors of req, and sets the
+// X-Request-Id header of req if it is not set. tf is the transferer serving
+// req, it is nil if req is not routed yet.
+func (b *Broker) errorContext(req *http.Request, route *RouteRecord, agent *Agent) ErrorContext {
+	id := req.Header.Get("X-Request-Id")
+	if id == "" {
+		id = newRequestID()
+		req.Header.Set("X-Request-Id", id)
+	}
+	ctx := ErrorContext{JSON: acceptsJSON(req), Page: b.ErrorPage, RequestID: id}
+	if route != nil {
+		ctx.Route = route.Key
+		if route.ErrorPage != nil {
+			ctx.Page = route.ErrorPage
+		}
+	}
+	if agent != nil {
+		ctx.AgentID = agent.ID
+	}
+	return ctx
+}
+
+// newRequestID returns a random id of 16 hex digits.
+func newRequestID() string {
+	var p [8]byte
+	rand.Read(p[:])
+	return hex.EncodeToString(p[:])
+}
+
+// gatewayError converts the error of reading a response from the upstream
+// to the HTTPError written to the client.
+func gatewayError(err error) error {
+	if he, ok := err.(HTTPError); ok {
+		return he
+	}
+	if isTimeout(err) {
+		return HErrGatewayTimeout
+	}
+	return HErrBadGateway
+}
+
+// bodyLimiter aborts tf with HErrRequestTooLarge if more than n bytes are
+// read from a request body of unknown length.
+type bodyLimiter struct {
+	io.ReadCloser
+	n  int64
+	tf *Transferer
+}
+
+func (l *bodyLimiter) Read(p []byte) (n int, err error) {
+	n, err = l.ReadCloser.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		l.tf.abort(HErrRequestTooLarge)
+		return 0, HErrRequestTooLarge
+	}
+	return
+}
+
+// isUpgrade reports whether req asks to upgrade the protocol, such as
+// WebSocket and h2c.
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether the comma separated values of header key
+// contain token, case-insensitively.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	tunnel.Close()
+// SetRoute replaces the route table of a serving broker. Transferers
+// created before keep using the old route.
+func (b *Broker) SetRoute(route Route) {
+	b.ev.ReplaceRoute <- route
 }
 
-func (b *Broker) CreateTransferer(host string) (tf *Transferer, err error) {
+// MatchRoute returns the route record of host and path.
+func (b *Broker) MatchRoute(host, path string) (route RouteRecord, err error) {
 	future := NewFuture()
-	b.ev.CreateTransferer <- BrokerEvCreateTransferer{
+	b.ev.MatchRoute <- BrokerEvMatchRoute{
 		Host:   host,
+		Path:   path,
 		future: future,
 	}
 	val, err := future.Result()
+	if err == nil {
+		route = val.(RouteRecord)
+	}
+	return
+}
+
+// CreateTransferer creates a transferer to the agent serving host and path,
+// clientAddr is the address of the client, it is also used to choose an
+// agent if there are many.
+func (b *Broker) CreateTransferer(host, path, clientAddr string) (tf *Transferer, err error) {
+	return b.createTransferer(BrokerEvCreateTransferer{
+		Host:       host,
+		Path:       path,
+		ClientAddr: clientAddr,
+	})
+}
+
+// CreateTunnel creates a transferer to an agent of route.
+func (b *Broker) CreateTunnel(route RouteRecord, clientAddr string) (tf *Transferer, err error) {
+	return b.createTransferer(BrokerEvCreateTransferer{
+		Route:      &route,
+		ClientAddr: clientAddr,
+	})
+}
+
+// CreatePacketTunnel creates a transferer of datagrams to an agent of route,
+// the agent sends the datagrams to a udp upstream.
+func (b *Broker) CreatePacketTunnel(route RouteRecord, clientAddr string) (tf *Transferer, err error) {
+	return b.createTransferer(BrokerEvCreateTransferer{
+		Route:      &route,
+		Packet:     true,
+		ClientAddr: clientAddr,
+	})
+}
+
+func (b *Broker) createTransferer(e BrokerEvCreateTransferer) (tf *Transferer, err error) {
+	e.future = NewFuture()
+	b.ev.CreateTransferer <- e
+	val, err := e.future.Result()
 	if err == nil {
 		tf = val.(*Transferer)
 	}
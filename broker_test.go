@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log = zap.NewNop().Sugar()
+}
+
+// startEchoServer starts a tcp server which writes back everything it reads.
+func startEchoServer(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return lsn
+}
+
+// listenLocal listens on a random port of localhost.
+func listenLocal(t *testing.T) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lsn
+}
+
+// serveTestBroker serves b on a random port with httpListeners, and returns
+// the address of the agent listener.
+func serveTestBroker(t *testing.T, b *Broker, httpListeners ...net.Listener) (addr string, stop func()) {
+	return serveTestBrokerOn(t, b, listenLocal(t), httpListeners...)
+}
+
+// serveTestBrokerOn is like serveTestBroker, but agents connect to agentLsn.
+func serveTestBrokerOn(t *testing.T, b *Broker, agentLsn net.Listener, httpListeners ...net.Listener) (addr string, stop func()) {
+	if len(httpListeners) == 0 {
+		httpListeners = append(httpListeners, listenLocal(t))
+	}
+
+	done := make(chan struct{})
+	b.done = done
+	served := make(chan struct{})
+	go func() {
+		b.serve(agentLsn, httpListeners...)
+		close(served)
+	}()
+
+	stop = func() {
+		close(done)
+		<-served
+	}
+	return agentLsn.Addr().String(), stop
+}
+
+// waitRoute waits until the agent of host is registered by the broker.
+func waitRoute(t *testing.T, b *Broker, host string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		tf, err := b.CreateTransferer(host, "/", "127.0.0.1")
+		if err == nil {
+			tf.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait route %s: %s", host, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// waitOffline waits until the agents of host are offline.
+func waitOffline(t *testing.T, b *Broker, host string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		tf, err := b.CreateTransferer(host, "/", "127.0.0.1")
+		if err == HErrAgentNotOnline {
+			return
+		}
+		if err == nil {
+			tf.Close()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait agents of %s offline: %v", host, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// startTestBroker starts a broker and an agent "test-agent" connected to it,
+// route should contain the record of "test.host".
+func startTestBroker(t *testing.T, route Route) (b *Broker, stop func()) {
+	b = &Broker{Token: "test-token"}
+	b.Init()
+	b.route = route
+	addr, stop := serveTestBroker(t, b)
+
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+	return
+}
+
+func TestAllocTID(t *testing.T) {
+	assert := assert.New(t)
+	a := NewAgent("test")
+	a.tfs["1"] = NewTransferer(nil)
+	a.tfs["2"] = NewTransferer(nil)
+
+	tid := a.allocTID()
+	assert.Equal("3", tid)
+	assert.NotEqual(tid, a.allocTID())
+}
+
+func TestReceiveLastDataExceedWindow(t *testing.T) {
+	assert := assert.New(t)
+	b := &Broker{}
+	b.Init()
+	agent := NewAgent("test-agent")
+	agent.conn, _ = net.Pipe()
+	tf := NewTransferer(nil)
+	agent.tfs["1"] = tf
+
+	b.eh_DispatchResponse(BEvDispatchMessage{Agent: agent, Msg: LastDataMessage{
+		DataMessage: DataMessage{TID: "1", Data: make([]byte, InitialWindowSize+1)},
+	}})
+	assert.NotContains(agent.tfs, "1")
+	_, err := tf.Read(make([]byte, 1))
+	assert.Equal(ErrWindowExceeded, err)
+	_, err = tf.Write([]byte("request"))
+	assert.Equal(ErrWindowExceeded, err)
+}
+
+func TestParallelTransfers(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	b, stop := startTestBroker(t, Route{
+		"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()},
+	})
+	defer stop()
+
+	const n = 2000
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	tids := make(map[string]bool)
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tf.Close()
+
+			mu.Lock()
+			if tids[tf.TID] {
+				errs <- fmt.Errorf("tid %s is reused", tf.TID)
+			}
+			tids[tf.TID] = true
+			mu.Unlock()
+
+			data := []byte(fmt.Sprintf("transfer #%d", i))
+			if _, err := tf.Write(data); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, len(data))
+			if _, err := io.ReadFull(tf, buf); err != nil {
+				errs <- err
+				return
+			}
+			if string(buf) != string(data) {
+				errs <- fmt.Errorf("transfer #%d received %q", i, buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSlowTransferNotBlockOthers(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	source, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	go func() {
+		for {
+			conn, err := source.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(make([]byte, 8*1024*1024))
+				conn.Close()
+			}()
+		}
+	}()
+
+	b, stop := startTestBroker(t, Route{
+		"test.host":   {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()},
+		"source.host": {AgentIDs: []string{"test-agent"}, Host: source.Addr().String()},
+	})
+	defer stop()
+
+	// never read from the slow transferer
+	slow, err := b.CreateTransferer("source.host", "/", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	done := make(chan error, 1)
+	go func() {
+		tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+		if err != nil {
+			done <- err
+			return
+		}
+		defer tf.Close()
+		tf.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(tf, buf)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("transfer is blocked by a slow transfer")
+	}
+}
+
+func TestDuplicateIDReject(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Token: "test-token", DuplicateID: DupReject}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	err := NewAgent("test-agent").Dial(addr, "test-token")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "already online")
+	}
+}
+
+func TestDuplicateIDReplace(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Token: "test-token", DuplicateID: DupReplace}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	old := make(chan error, 1)
+	go func() {
+		old <- NewAgent("test-agent").Connect(addr, "test-token")
+	}()
+	waitRoute(t, b, "test.host")
+
+	agent := NewAgent("test-agent")
+	if err := agent.Dial(addr, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	go agent.Serve()
+
+	select {
+	case <-old:
+	case <-time.After(time.Second * 5):
+		t.Fatal("old agent is not closed")
+	}
+	waitRoute(t, b, "test.host")
+}
+
+func TestDuplicateIDBalance(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Token: "test-token", DuplicateID: DupBalance}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		agent := NewAgent("test-agent")
+		if err := agent.Dial(addr, "test-token"); err != nil {
+			t.Fatal(err)
+		}
+		go agent.Serve()
+	}
+	waitRoute(t, b, "test.host")
+
+	// tids are allocated by each agent, so they repeat only if both agents
+	// are used
+	tids := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+		if assert.Nil(err) {
+			tids[tf.TID] = true
+			tf.Close()
+		}
+	}
+	assert.True(len(tids) < 4, "transfers are not balanced")
+}
+
+func TestSetRoute(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+	b, stop := startTestBroker(t, Route{
+		"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()},
+	})
+	defer stop()
+
+	tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+
+	b.SetRoute(Route{})
+	_, err = b.CreateTransferer("test.host", "/", "127.0.0.1")
+	assert.Equal(HErrNoRouteRecort, err)
+
+	// the transferer created before keeps working
+	tf.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(tf, buf)
+	assert.Nil(err)
+	assert.Equal("ping", string(buf))
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	assert := assert.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.URL.Path, body)
+	}))
+	defer backend.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: backend.Listener.Addr().String()}}
+	httpLsn := listenLocal(t)
+	addr, stop := serveTestBroker(t, b, httpLsn)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	conn, err := net.Dial("tcp", httpLsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	// the requests are pipelined, the responses must be in the same order
+	const n = 5
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(conn, "POST /%d HTTP/1.1\r\nHost: test.host\r\nContent-Length: 4\r\n\r\nbody", i)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < n; i++ {
+		resp, err := http.ReadResponse(r, nil)
+		if !assert.Nil(err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal(fmt.Sprintf("/%d body", i), string(body))
+	}
+}
+
+func TestHTTPKeepAliveRouteReload(t *testing.T) {
+	assert := assert.New(t)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	web, api := newBackend("web"), newBackend("api")
+	defer web.Close()
+	defer api.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: web.Listener.Addr().String()}}
+	httpLsn := listenLocal(t)
+	addr, stop := serveTestBroker(t, b, httpLsn)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	conn, err := net.Dial("tcp", httpLsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+	get := func() (int, string) {
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test.host\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if !assert.Nil(err) {
+			t.FailNow()
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := get()
+	assert.Equal("web", body)
+
+	// later requests of the connection are served by the reloaded route
+	b.SetRoute(Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: api.Listener.Addr().String()}})
+	_, body = get()
+	assert.Equal("api", body)
+
+	b.SetRoute(Route{"test.host": {
+		AgentIDs: []string{"test-agent"},
+		Host:     api.Listener.Addr().String(),
+		Auth:     Passwords{"alice": mustHashPassword("secret")},
+	}})
+	status, _ := get()
+	assert.Equal(http.StatusUnauthorized, status)
+}
+
+func TestHTTPPathRouting(t *testing.T) {
+	assert := assert.New(t)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	web, api := newBackend("web"), newBackend("api")
+	defer web.Close()
+	defer api.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{
+		"test.host":     {AgentIDs: []string{"test-agent"}, Host: web.Listener.Addr().String()},
+		"test.host/api": {AgentIDs: []string{"test-agent"}, Host: api.Listener.Addr().String(), StripPrefix: true},
+	}
+	httpLsn := listenLocal(t)
+	addr, stop := serveTestBroker(t, b, httpLsn)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	// requests of a keep-alive connection may be routed differently
+	dials := 0
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dials++
+			return net.Dial(network, httpLsn.Addr().String())
+		},
+	}}
+	for path, want := range map[string]string{
+		"/index.html": "web /index.html",
+		"/api/users":  "api /users",
+		"/apix":       "web /apix",
+		"/api":        "api /",
+	} {
+		resp, err := client.Get("http://TEST.host:8080" + path)
+		if !assert.Nil(err) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(want, string(body))
+	}
+	assert.Equal(1, dials)
+}
+
+func TestAgentExposeRoute(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Credentials: Credentials{
+		"test-agent": {
+			digest: mustParseTokenHash(HashToken("test-token")),
+			Expose: []string{"*.test.host"},
+		},
+	}}
+	b.Init()
+	b.route = Route{
+		"file.test.host":  {AgentIDs: []string{"other-agent"}, Host: "127.0.0.1:1"},
+		"agent.test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()},
+	}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	// agents failing to register are offline
+	for _, host := range []string{"other.host", "file.test.host"} {
+		agent := NewAgent("test-agent")
+		agent.Expose = map[string]string{host: echo.Addr().String()}
+		assert.NotNil(agent.Dial(addr, "test-token"), host)
+		waitOffline(t, b, "agent.test.host")
+	}
+
+	agent := NewAgent("test-agent")
+	agent.Expose = map[string]string{"app.test.host": echo.Addr().String()}
+	if err := agent.Dial(addr, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- agent.Serve()
+	}()
+	waitRoute(t, b, "app.test.host")
+
+	// the route is removed when the agent is offline
+	agent.closeConn()
+	<-served
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		_, err := b.MatchRoute("app.test.host", "/")
+		if err == HErrNoRouteRecort {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("route is not removed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRegisterRouteSendOKFailed(t *testing.T) {
+	assert := assert.New(t)
+	b := &Broker{Credentials: Credentials{
+		"test-agent": {Expose: []string{"*.test.host"}},
+	}}
+	b.Init()
+	agent := NewAgent("test-agent")
+	agent.conn, _ = net.Pipe()
+	agent.mw = NewMessageWriter(agent.conn)
+	agent.mw.Close()
+	b.agents[agent.ID] = []*Agent{agent}
+
+	b.eh_RegisterRoute(BEvRegisterRoute{
+		Agent:  agent,
+		Routes: map[string]string{"app.test.host": "127.0.0.1:80"},
+	})
+	assert.False(b.isOnline(agent))
+	assert.Empty(b.exposed)
+}
+
+func TestHTTPUpgrade(t *testing.T) {
+	assert := assert.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.Write([]byte("not upgraded"))
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: backend.Listener.Addr().String()}}
+	httpLsn := listenLocal(t)
+	addr, stop := serveTestBroker(t, b, httpLsn)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	conn, err := net.Dial("tcp", httpLsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	// the data sent right after the request must not be lost
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test.host\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello"))
+
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal("echo", resp.Header.Get("Upgrade"))
+
+	conn.Write([]byte(" world"))
+	conn.(*net.TCPConn).CloseWrite()
+	data, err := ioutil.ReadAll(rd)
+	assert.Nil(err)
+	assert.Equal("hello world", string(data))
+}
+
+// zeroReader reads endless zeros without allocating them.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// windowWriter sends data of a transfer as DataMessages within window.
+type windowWriter struct {
+	mw     *MessageWriter
+	tid    string
+	window *Window
+}
+
+func (w *windowWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		k, err := w.window.Take(len(p) - n)
+		if err != nil {
+			return n, err
+		}
+		if err = w.mw.Write(DataMessage{TID: w.tid, Data: p[n : n+k]}); err != nil {
+			return n, err
+		}
+		n += k
+	}
+	return
+}
+
+// startFakeAgent connects to broker as "test-agent" and serves each transfer
+// with handle, which reads the data of transfer from r and writes back to w.
+// It speaks the protocol directly, so only the broker is tested.
+func startFakeAgent(t *testing.T, addr string, handle func(r io.Reader, w io.Writer)) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(AuthMessage{ID: "test-agent", Token: "test-token"}.Bytes())
+	msgr := NewMessageReader(conn)
+	if msg, err := msgr.Read(); err != nil || msg != (TextMessage{Content: "OK"}) {
+		t.Fatalf("auth fake agent: %v %v", msg, err)
+	}
+	mw := NewMessageWriter(conn)
+
+	type stream struct {
+		recv   *StreamBuffer
+		window *Window
+	}
+	go func() {
+		defer conn.Close()
+		streams := make(map[string]*stream)
+		for {
+			msg, err := msgr.Read()
+			if err != nil {
+				return
+			}
+			switch m := msg.(type) {
+			case FirstDataMessage:
+				tid := m.TID
+				s := &stream{
+					recv: NewStreamBuffer(func(n int) {
+						mw.Write(WindowUpdateMessage{TID: tid, Size: n})
+					}),
+					window: NewWindow(InitialWindowSize),
+				}
+				streams[tid] = s
+				go func() {
+					handle(s.recv, &windowWriter{mw: mw, tid: tid, window: s.window})
+					mw.Write(LastDataMessage{DataMessage: DataMessage{TID: tid}})
+				}()
+			case DataMessage:
+				if s, ok := streams[m.TID]; ok {
+					s.recv.Write(m.Data)
+				}
+			case LastDataMessage:
+				if s, ok := streams[m.TID]; ok {
+					s.recv.Close()
+					s.window.SetError(io.ErrClosedPipe)
+					delete(streams, m.TID)
+				}
+			case WindowUpdateMessage:
+				if s, ok := streams[m.TID]; ok {
+					s.window.Add(m.Size)
+				}
+			}
+		}
+	}()
+}
+
+func TestStreamLargeBody(t *testing.T) {
+	assert := assert.New(t)
+	const size = 128 * 1024 * 1024
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: "upstream"}}
+	httpLsn := listenLocal(t)
+	addr, stop := serveTestBroker(t, b, httpLsn)
+	defer stop()
+
+	// the fake agent discards the request body and responds with a body of
+	// the same size, both are chunked with trailers
+	startFakeAgent(t, addr, func(r io.Reader, w io.Writer) {
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		resp := &http.Response{
+			StatusCode: 200,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"X-Received":        {fmt.Sprint(n)},
+				"X-Request-Trailer": {req.Trailer.Get("X-Checksum")},
+			},
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+			Body:             ioutil.NopCloser(io.LimitReader(zeroReader{}, n)),
+			Trailer:          http.Header{"X-Sent": {fmt.Sprint(n)}},
+		}
+		resp.Write(w)
+	})
+	waitRoute(t, b, "test.host")
+
+	var baseline, peak runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&baseline)
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak.HeapInuse {
+				peak = m
+			}
+		}
+	}()
+
+	req, _ := http.NewRequest("POST", "http://"+httpLsn.Addr().String(), io.LimitReader(zeroReader{}, size))
+	req.Host = "test.host"
+	req.Trailer = http.Header{"X-Checksum": {"test-checksum"}}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(err) {
+		close(done)
+		return
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	close(done)
+	<-sampled
+
+	assert.Nil(err)
+	assert.Equal(int64(size), n)
+	assert.Equal([]string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(fmt.Sprint(size), resp.Header.Get("X-Received"))
+	assert.Equal("test-checksum", resp.Header.Get("X-Request-Trailer"))
+	assert.Equal(fmt.Sprint(size), resp.Trailer.Get("X-Sent"))
+	// the bodies are streamed, so memory grows far less than their size
+	growth := int64(peak.HeapInuse) - int64(baseline.HeapInuse)
+	assert.True(growth < 32*1024*1024, "heap grows %d bytes", growth)
+}
+
+// startSlowBackend starts a backend responding "done", after 300ms for
+// "/slow", and after release is closed for "/hang".
+func startSlowBackend(release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Millisecond * 300)
+		} else if r.URL.Path == "/hang" {
+			<-release
+		}
+		w.Write([]byte("done"))
+	}))
+}
+
+// shutdownCases are the requests in flight when the broker or an agent is
+// shutting down, a request is served if it finishes within timeout.
+var shutdownCases = []struct {
+	path    string
+	timeout time.Duration
+	served  bool
+}{
+	{"/slow", time.Second * 5, true},
+	{"/hang", time.Millisecond * 200, false},
+}
+
+// inflightRequest is a request sent through a broker and an agent.
+type inflightRequest struct {
+	// addr and httpAddr are the listening addresses of the broker.
+	addr, httpAddr string
+	stop           func()
+	// agentErr receives the error returned by Serve of the agent.
+	agentErr chan error
+	// body receives the response body, or the error of the request.
+	body chan string
+}
+
+// startInflightRequest serves b and agent, then sends a request of path to
+// backend through them.
+func startInflightRequest(t *testing.T, b *Broker, agent *Agent, backend *httptest.Server, path string) (r inflightRequest) {
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{agent.ID}, Host: backend.Listener.Addr().String()}}
+	httpLsn := listenLocal(t)
+	r.httpAddr = httpLsn.Addr().String()
+	r.addr, r.stop = serveTestBroker(t, b, httpLsn)
+
+	if err := agent.Dial(r.addr, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	r.agentErr = make(chan error, 1)
+	go func() {
+		r.agentErr <- agent.Serve()
+	}()
+	waitRoute(t, b, "test.host")
+
+	r.body = make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+r.httpAddr+path, nil)
+		req.Host = "test.host"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			r.body <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		r.body <- string(data)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	return
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	backend := startSlowBackend(release)
+	defer backend.Close()
+	defer close(release)
+
+	for _, c := range shutdownCases {
+		b := &Broker{Token: "test-token", ShutdownGrace: c.timeout}
+		r := startInflightRequest(t, b, NewAgent("test-agent"), backend, c.path)
+
+		start := time.Now()
+		r.stop()
+		elapsed := time.Since(start)
+		if c.served {
+			assert.Equal("done", <-r.body)
+			assert.True(elapsed < c.timeout, "shutdown waits %s", elapsed)
+		} else {
+			assert.NotEqual("done", <-r.body)
+			assert.True(elapsed >= c.timeout, "shutdown waits %s", elapsed)
+		}
+		assert.Equal(ErrBrokerGoAway, <-r.agentErr)
+
+		// new connections are not accepted
+		_, err := net.Dial("tcp", r.httpAddr)
+		assert.NotNil(err)
+	}
+}
+
+func TestAgentGoAway(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	backend := startSlowBackend(release)
+	defer backend.Close()
+	defer close(release)
+
+	for _, c := range shutdownCases {
+		b := &Broker{Token: "test-token"}
+		agent := NewAgent("test-agent")
+		agent.DrainTimeout = c.timeout
+		r := startInflightRequest(t, b, agent, backend, c.path)
+
+		start := time.Now()
+		agent.Close()
+
+		// new transfers are not routed to the agent going away, and its id
+		// can be taken by a new agent
+		waitOffline(t, b, "test.host")
+		go NewAgent("test-agent").Connect(r.addr, "test-token")
+		waitRoute(t, b, "test.host")
+
+		if c.served {
+			assert.Equal("done", <-r.body)
+		} else {
+			assert.NotEqual("done", <-r.body)
+		}
+		assert.Nil(<-r.agentErr)
+		elapsed := time.Since(start)
+		if c.served {
+			assert.True(elapsed < c.timeout, "agent closes in %s", elapsed)
+		} else {
+			assert.True(elapsed >= c.timeout, "agent closes in %s", elapsed)
+		}
+		r.stop()
+	}
+}
+
+func TestHTTPGatewayErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	// silent accepts connections and reads requests without responding
+	silent := listenLocal(t)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	refused := listenLocal(t)
+	refused.Close()
+
+	timeout := Duration(time.Millisecond * 100)
+	b, stop := startTestBroker(t, Route{
+		"test.host":       {AgentIDs: []string{"test-agent"}, Host: silent.Addr().String()},
+		"refused.host":    {AgentIDs: []string{"test-agent"}, Host: refused.Addr().String()},
+		"first-byte.host": {AgentIDs: []string{"test-agent"}, Host: silent.Addr().String(), Timeouts: Timeouts{FirstByte: timeout}},
+		"idle.host":       {AgentIDs: []string{"test-agent"}, Host: silent.Addr().String(), Timeouts: Timeouts{Idle: timeout}},
+		"limit.host":      {AgentIDs: []string{"test-agent"}, Host: silent.Addr().String(), MaxBodySize: 10},
+	})
+	defer stop()
+	httpLsn := listenLocal(t)
+	go b.acceptHTTPRequest(httpLsn)
+	defer httpLsn.Close()
+
+	for _, c := range []struct {
+		host   string
+		body   io.Reader
+		status int
+	}{
+		{"refused.host", nil, http.StatusBadGateway},
+		{"first-byte.host", nil, http.StatusGatewayTimeout},
+		{"idle.host", nil, http.StatusGatewayTimeout},
+		{"limit.host", strings.NewReader(strings.Repeat("x", 100)), http.StatusRequestEntityTooLarge},
+		// the length of a chunked body is unknown until it is read
+		{"limit.host", io.MultiReader(strings.NewReader(strings.Repeat("x", 100))), http.StatusRequestEntityTooLarge},
+	} {
+		method := "GET"
+		if c.body != nil {
+			method = "POST"
+		}
+		req, _ := http.NewRequest(method, "http://"+httpLsn.Addr().String(), c.body)
+		req.Host = c.host
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(err, c.host) {
+			assert.Equal(c.status, resp.StatusCode, c.host)
+			resp.Body.Close()
+		}
+	}
+
+	// API clients get errors as JSON, and the request id is forwarded
+	req, _ := http.NewRequest("GET", "http://"+httpLsn.Addr().String(), nil)
+	req.Host = "refused.host"
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-Id", "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("application/json", resp.Header.Get("Content-Type"))
+		assert.Contains(string(body), `"route":"refused.host"`)
+		assert.Contains(string(body), `"agentId":"test-agent"`)
+		assert.Contains(string(body), `"requestId":"test-request"`)
+	}
+}
+
+func TestHTTPForwardedHeaders(t *testing.T) {
+	assert := assert.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded", "X-Hop"} {
+			w.Header().Set("Got-"+key, r.Header.Get(key))
+		}
+		w.Header().Set("Connection", "X-Hop-Response")
+		w.Header().Set("X-Hop-Response", "1")
+	}))
+	defer backend.Close()
+
+	upstream := backend.Listener.Addr().String()
+	b, stop := startTestBroker(t, Route{
+		"test.host":    {AgentIDs: []string{"test-agent"}, Host: upstream},
+		"trusted.host": {AgentIDs: []string{"test-agent"}, Host: upstream, TrustForwarded: true},
+	})
+	defer stop()
+	httpLsn := listenLocal(t)
+	go b.acceptHTTPRequest(httpLsn)
+	defer httpLsn.Close()
+
+	for host, xff := range map[string]string{
+		"test.host":    "127.0.0.1",
+		"trusted.host": "10.0.0.1, 127.0.0.1",
+	} {
+		req, _ := http.NewRequest("GET", "http://"+httpLsn.Addr().String(), nil)
+		req.Host = host
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nil(err) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(xff, resp.Header.Get("Got-X-Forwarded-For"), host)
+		assert.Equal(host, resp.Header.Get("Got-X-Forwarded-Host"))
+		assert.Equal("http", resp.Header.Get("Got-X-Forwarded-Proto"))
+		assert.Contains(resp.Header.Get("Got-Forwarded"), "for=127.0.0.1;host="+host+";proto=http")
+		assert.Empty(resp.Header.Get("Got-X-Hop"))
+		assert.Empty(resp.Header.Get("X-Hop-Response"))
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
@@ -14,24 +17,68 @@ var (
 		Run:   brokerCmdHandler,
 	}
 	agentCmd = &cobra.Command{
-		Use:   "connect [address]",
-		Short: "Connect to hrt broker",
+		Use:   "connect [address...]",
+		Short: "Connect to hrt broker, other addresses are tried when a broker is unreachable or shutting down",
 		Args:  cobra.MinimumNArgs(1),
 		Run:   agentCmdHandler,
 	}
+	hashTokenCmd = &cobra.Command{
+		Use:   "hash-token [token]",
+		Short: "Print the hashed token used in credentials file",
+		Args:  cobra.ExactArgs(1),
+		Run:   hashTokenCmdHandler,
+	}
+	hashPasswordCmd = &cobra.Command{
+		Use:   "hash-password [password]",
+		Short: "Print the hashed password used in the auth of routes",
+		Args:  cobra.ExactArgs(1),
+		Run:   hashPasswordCmdHandler,
+	}
 )
 
 func init() {
 	bflags := brokerCmd.Flags()
 	bflags.StringP("listen", "l", ":9090", "hrt broker listening address")
 	bflags.String("http", ":8080", "http service listening address")
+	bflags.String("https", "", "https service listening address")
+	bflags.String("https-certs", "", "directory of PEM files containing the certificates and keys of https service")
 	bflags.String("route", "", "route file path")
+	bflags.String("error-page", "", "template file of HTML error pages, routes can override it with errorPage")
+	bflags.StringArray("tcp", nil, "raw tcp tunnel as listen-address=agent-ids:upstream, such as :2222=agent-a:127.0.0.1:22, can be repeated")
+	bflags.Int("tcp-proxy-protocol", 0, "send a PROXY protocol header of this version (1 or 2) to the upstreams of tcp tunnels, 0 to disable")
+	bflags.StringArray("udp", nil, "udp tunnel as listen-address=agent-ids:upstream, such as :5353=agent-a:127.0.0.1:53, can be repeated")
+	bflags.Duration("udp-idle", DefaultUDPIdleTimeout, "close udp sessions idle for this long")
+	bflags.Bool("accept-proxy-protocol", false, "require a PROXY protocol header on http, https and tcp tunnel connections, such as behind a load balancer")
+	bflags.Duration("shutdown-grace", time.Second*30, "time to wait for in-flight transfers on SIGINT or SIGTERM")
+	bflags.Duration("heartbeat", time.Second*15, "interval to ping agents, 0 to disable")
+	bflags.Int("heartbeat-misses", 3, "consider an agent offline after missing this many pings in a row")
+	bflags.Duration("route-reload", time.Second*5, "interval to check the route file for changes, 0 to reload only on SIGHUP")
 	bflags.String("token", "", "")
+	bflags.String("credentials", "", "credentials file which maps agent ids to hashed tokens")
+	bflags.String("balance", BalanceRoundRobin, "default strategy to choose one of the agents serving a route: round-robin, least-active or hash")
+	bflags.String("duplicate-id", DupReplace, "what to do when an agent connects with the id of an online agent: reject, replace or balance")
+	bflags.String("tls-cert", "", "certificate file of the agent listener")
+	bflags.String("tls-key", "", "private key file of the agent listener")
+	bflags.String("tls-client-ca", "", "require agents to present a certificate signed by this CA, the common name is used as agent id")
 
 	aflags := agentCmd.Flags()
 	aflags.String("token", "", "")
 	aflags.String("id", "", "agent id")
-	rootCmd.AddCommand(brokerCmd, agentCmd)
+	aflags.String("group", "", "agent group to join, routes can be served by all agents of a group")
+	aflags.StringArray("expose", nil, "expose a local service as host=address, such as app.example.com=127.0.0.1:8000, can be repeated")
+	aflags.Bool("tls", false, "connect to broker with TLS")
+	aflags.String("tls-ca", "", "CA certificate file to verify broker, implies --tls")
+	aflags.Bool("insecure", false, "do not verify the certificate of broker, implies --tls")
+	aflags.String("tls-cert", "", "client certificate file, implies --tls")
+	aflags.String("tls-key", "", "private key file of client certificate")
+	aflags.Duration("drain-timeout", time.Second*30, "time to wait for local connections on SIGINT or SIGTERM")
+	aflags.Duration("heartbeat", time.Second*15, "interval to ping broker, 0 to disable")
+	aflags.Int("heartbeat-misses", 3, "reconnect after broker misses this many pings in a row")
+	aflags.Bool("reconnect", true, "reconnect to broker when the connection is broken")
+	aflags.Duration("backoff-min", time.Second, "minimum delay before reconnecting")
+	aflags.Duration("backoff-max", time.Minute, "maximum delay before reconnecting")
+	aflags.Float64("backoff-jitter", 0.2, "random jitter of reconnecting delay, as a fraction of the delay")
+	rootCmd.AddCommand(brokerCmd, agentCmd, hashTokenCmd, hashPasswordCmd)
 }
 
 func brokerCmdHandler(cmd *cobra.Command, args []string) {
@@ -39,16 +86,60 @@ func brokerCmdHandler(cmd *cobra.Command, args []string) {
 	flags := cmd.Flags()
 	conf.listen, _ = flags.GetString("listen")
 	conf.http, _ = flags.GetString("http")
+	conf.https, _ = flags.GetString("https")
+	conf.httpsCerts, _ = flags.GetString("https-certs")
 	conf.token, _ = flags.GetString("token")
 	conf.route, _ = flags.GetString("route")
+	conf.errorPage, _ = flags.GetString("error-page")
+	conf.tcp, _ = flags.GetStringArray("tcp")
+	conf.tcpProxy, _ = flags.GetInt("tcp-proxy-protocol")
+	conf.udp, _ = flags.GetStringArray("udp")
+	conf.udpIdle, _ = flags.GetDuration("udp-idle")
+	conf.acceptProxy, _ = flags.GetBool("accept-proxy-protocol")
+	conf.routeReload, _ = flags.GetDuration("route-reload")
+	conf.shutdownGrace, _ = flags.GetDuration("shutdown-grace")
+	conf.heartbeat.Interval, _ = flags.GetDuration("heartbeat")
+	conf.heartbeat.MaxMissed, _ = flags.GetInt("heartbeat-misses")
+	conf.creds, _ = flags.GetString("credentials")
+	conf.dupID, _ = flags.GetString("duplicate-id")
+	conf.balance, _ = flags.GetString("balance")
+	conf.tlsCert, _ = flags.GetString("tls-cert")
+	conf.tlsKey, _ = flags.GetString("tls-key")
+	conf.tlsClientCA, _ = flags.GetString("tls-client-ca")
 	StartBroker(conf)
 }
 
 func agentCmdHandler(cmd *cobra.Command, args []string) {
 	var conf AgentConf
 	flags := cmd.Flags()
-	conf.addr = args[0]
+	conf.addrs = args
 	conf.token, _ = flags.GetString("token")
 	conf.id, _ = flags.GetString("id")
+	conf.group, _ = flags.GetString("group")
+	conf.expose, _ = flags.GetStringArray("expose")
+	conf.tls, _ = flags.GetBool("tls")
+	conf.tlsCA, _ = flags.GetString("tls-ca")
+	conf.insecureSkipVerify, _ = flags.GetBool("insecure")
+	conf.tlsCert, _ = flags.GetString("tls-cert")
+	conf.tlsKey, _ = flags.GetString("tls-key")
+	conf.drainTimeout, _ = flags.GetDuration("drain-timeout")
+	conf.heartbeat.Interval, _ = flags.GetDuration("heartbeat")
+	conf.heartbeat.MaxMissed, _ = flags.GetInt("heartbeat-misses")
+	conf.reconnect, _ = flags.GetBool("reconnect")
+	conf.backoff.Min, _ = flags.GetDuration("backoff-min")
+	conf.backoff.Max, _ = flags.GetDuration("backoff-max")
+	conf.backoff.Jitter, _ = flags.GetFloat64("backoff-jitter")
 	StartAgent(conf)
 }
+
+func hashTokenCmdHandler(cmd *cobra.Command, args []string) {
+	fmt.Println(HashToken(args[0]))
+}
+
+func hashPasswordCmdHandler(cmd *cobra.Command, args []string) {
+	hash, err := HashPassword(args[0])
+	if err != nil {
+		log.Fatal("hash password: ", err)
+	}
+	fmt.Println(hash)
+}
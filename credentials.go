@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const tokenHashPrefix = "sha256:"
+
+// Credentials maps agent IDs to their credential.
+type Credentials map[string]Credential
+
+type Credential struct {
+	// Token is the hashed token, see HashToken.
+	Token string
+	// Groups are the agent groups the agent is allowed to join.
+	Groups []string
+	// Expose are the hosts the agent is allowed to expose, such as
+	// "app.example.com" or "*.dev.example.com".
+	Expose []string
+
+	digest []byte
+}
+
+// HashToken returns the hashed form of token which is stored in the
+// credentials file.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+func ReadCredentials(filename string) (c Credentials, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&c); err != nil {
+		return
+	}
+	for id, cred := range c {
+		if cred.digest, err = parseTokenHash(cred.Token); err != nil {
+			return nil, fmt.Errorf("token of %s: %s", id, err)
+		}
+		c[id] = cred
+	}
+	return
+}
+
+func parseTokenHash(hash string) ([]byte, error) {
+	if !strings.HasPrefix(hash, tokenHashPrefix) {
+		return nil, fmt.Errorf("not a %s hash", tokenHashPrefix)
+	}
+	digest, err := hex.DecodeString(hash[len(tokenHashPrefix):])
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errors.New("not a valid hash")
+	}
+	return digest, nil
+}
+
+// Verify reports whether token belongs to the agent id. The comparison takes
+// the same time no matter whether id exists or where the token differs.
+func (c Credentials) Verify(id, token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	cred, ok := c[id]
+	if !ok {
+		// compare anyway so an unknown id takes as long as a known one
+		subtle.ConstantTimeCompare(sum[:], make([]byte, sha256.Size))
+		return false
+	}
+	return subtle.ConstantTimeCompare(sum[:], cred.digest) == 1
+}
+
+func (c Credentials) InGroup(id, group string) bool {
+	for _, g := range c[id].Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// CanExpose reports whether the agent id is allowed to expose host.
+func (c Credentials) CanExpose(id, host string) bool {
+	host = normalizeHost(host)
+	for _, pattern := range c[id].Expose {
+		if matchHost(normalizeHost(pattern), host) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Passwords maps user names to the bcrypt hashes of their passwords, see
+// HashPassword.
+type Passwords map[string][]byte
+
+var (
+	dummyPasswordOnce sync.Once
+	dummyPassword     []byte
+)
+
+// HashPassword returns the bcrypt hash of password which is used in the auth
+// of routes.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func parsePasswordHash(hash string) ([]byte, error) {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return nil, errors.New("not a bcrypt hash")
+	}
+	return []byte(hash), nil
+}
+
+// Verify reports whether password belongs to user. An unknown user is
+// checked against a dummy hash so it takes as long as a known one.
+func (p Passwords) Verify(user, password string) bool {
+	hash, ok := p[user]
+	if !ok {
+		dummyPasswordOnce.Do(func() {
+			dummyPassword, _ = bcrypt.GenerateFromPassword(nil, bcrypt.DefaultCost)
+		})
+		hash = dummyPassword
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+}
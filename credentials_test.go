@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	return writeTempFileExt(t, "", content)
+}
+
+// writeTempFileExt writes content to a temp file with extension ext.
+func writeTempFileExt(t *testing.T, ext, content string) string {
+	f, err := ioutil.TempFile("", "hrt-test*"+ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestHashToken(t *testing.T) {
+	assert.Equal(t,
+		"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		HashToken("test"))
+}
+
+func TestReadCredentials(t *testing.T) {
+	assert := assert.New(t)
+	filename := writeTempFile(t, `{
+		"agent-a": {"token": "`+HashToken("token-a")+`"},
+		"agent-b": {"token": "`+HashToken("token-b")+`"}
+	}`)
+	defer os.Remove(filename)
+
+	c, err := ReadCredentials(filename)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(c.Verify("agent-a", "token-a"))
+	assert.True(c.Verify("agent-b", "token-b"))
+	assert.False(c.Verify("agent-a", "token-b"))
+	assert.False(c.Verify("agent-c", "token-a"))
+	assert.False(c.Verify("agent-a", ""))
+}
+
+func TestReadCredentialsPlainToken(t *testing.T) {
+	filename := writeTempFile(t, `{"agent-a": {"token": "token-a"}}`)
+	defer os.Remove(filename)
+
+	_, err := ReadCredentials(filename)
+	assert.NotNil(t, err)
+}
+
+func TestPasswordsVerify(t *testing.T) {
+	assert := assert.New(t)
+	hash, err := HashPassword("secret")
+	if !assert.Nil(err) {
+		return
+	}
+	digest, err := parsePasswordHash(hash)
+	if !assert.Nil(err) {
+		return
+	}
+	p := Passwords{"alice": digest}
+	assert.True(p.Verify("alice", "secret"))
+	assert.False(p.Verify("alice", "wrong"))
+	assert.False(p.Verify("bob", "secret"))
+
+	_, err = parsePasswordHash(HashToken("secret"))
+	assert.NotNil(err)
+}
+
+func TestCredentialsCanExpose(t *testing.T) {
+	assert := assert.New(t)
+	c := Credentials{"agent-a": {Expose: []string{"app.example.com", "*.dev.example.com"}}}
+	assert.True(c.CanExpose("agent-a", "app.example.com"))
+	assert.True(c.CanExpose("agent-a", "APP.example.com:80"))
+	assert.True(c.CanExpose("agent-a", "x.dev.example.com"))
+	assert.True(c.CanExpose("agent-a", "*.x.dev.example.com"))
+	assert.False(c.CanExpose("agent-a", "dev.example.com"))
+	assert.False(c.CanExpose("agent-a", "other.example.com"))
+	assert.False(c.CanExpose("agent-b", "app.example.com"))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are meaningful only for a single connection, they are not
+// forwarded. See RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upgradeHeaders are the hop-by-hop headers which are part of the upgrade to
+// a protocol, they are kept for the upgrade.
+var upgradeHeaders = map[string][]string{
+	// RFC 7540 section 3.2.1
+	"h2c": {"Http2-Settings"},
+}
+
+// forwardedHeaders are the headers set by setForwardedHeaders.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// removeHopHeaders removes the hop-by-hop headers of h, including the ones
+// listed in Connection. Upgrade, Connection and the upgradeHeaders of the
+// protocols are kept for upgrade, and "TE: trailers" is kept since it tells
+// the upstream that trailers are supported.
+func removeHopHeaders(h http.Header, upgrade bool) {
+	trailers := headerHasToken(h, "Te", "trailers")
+	protocol := h.Get("Upgrade")
+	var keys []string
+	var values [][]string
+	if upgrade {
+		for _, p := range strings.Split(protocol, ",") {
+			// a protocol may have a version, such as "HTTP/2.0"
+			name := strings.ToLower(strings.TrimSpace(p))
+			if i := strings.IndexByte(name, '/'); i >= 0 {
+				name = name[:i]
+			}
+			for _, key := range upgradeHeaders[name] {
+				if v, ok := h[key]; ok {
+					keys, values = append(keys, key), append(values, v)
+				}
+			}
+		}
+	}
+	for _, v := range h["Connection"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	if upgrade {
+		h.Set("Connection", strings.Join(append([]string{"Upgrade"}, keys...), ", "))
+		h.Set("Upgrade", protocol)
+		for i, key := range keys {
+			h[key] = values[i]
+		}
+	}
+}
+
+// setForwardedHeaders tells the upstream about the client of req. The
+// headers sent by the client are extended if trust is true, otherwise they
+// are replaced. It must be called before req.Host is rewritten.
+func setForwardedHeaders(req *http.Request, clientIP, proto string, trust bool) {
+	h := req.Header
+	if !trust {
+		for _, key := range forwardedHeaders {
+			h.Del(key)
+		}
+	}
+
+	if prior := h.Get("X-Forwarded-For"); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		h.Set("X-Forwarded-For", clientIP)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Real-Ip") == "" {
+		h.Set("X-Real-Ip", clientIP)
+	}
+
+	// RFC 7239, IPv6 addresses are enclosed in brackets
+	node := clientIP
+	if ip := net.ParseIP(clientIP); ip != nil && ip.To4() == nil {
+		node = "[" + clientIP + "]"
+	}
+	elem := "for=" + forwardedValue(node) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+	if prior := h.Get("Forwarded"); prior != "" {
+		elem = prior + ", " + elem
+	}
+	h.Set("Forwarded", elem)
+}
+
+// forwardedValue quotes s unless it is a token, see RFC 7239 section 4.
+func forwardedValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, c := range s {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	return s
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return c < 0x80 && strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	assert := assert.New(t)
+	h := http.Header{
+		"Connection":   {"keep-alive, X-Hop"},
+		"Keep-Alive":   {"timeout=5"},
+		"X-Hop":        {"1"},
+		"Te":           {"trailers, deflate"},
+		"Upgrade":      {"websocket"},
+		"Content-Type": {"text/plain"},
+	}
+	removeHopHeaders(h, false)
+	assert.Equal(http.Header{
+		"Te":           {"trailers"},
+		"Content-Type": {"text/plain"},
+	}, h)
+
+	h = http.Header{
+		"Connection": {"Upgrade, X-Hop"},
+		"X-Hop":      {"1"},
+		"Upgrade":    {"websocket"},
+	}
+	removeHopHeaders(h, true)
+	assert.Equal(http.Header{
+		"Connection": {"Upgrade"},
+		"Upgrade":    {"websocket"},
+	}, h)
+
+	h = http.Header{
+		"Connection":     {"Upgrade, HTTP2-Settings, X-Hop"},
+		"X-Hop":          {"1"},
+		"Upgrade":        {"h2c"},
+		"Http2-Settings": {"AAMAAABkAAQAoAAAAAIAAAAA"},
+	}
+	removeHopHeaders(h, true)
+	assert.Equal(http.Header{
+		"Connection":     {"Upgrade, Http2-Settings"},
+		"Upgrade":        {"h2c"},
+		"Http2-Settings": {"AAMAAABkAAQAoAAAAAIAAAAA"},
+	}, h)
+
+	// the upgrade headers are removed if the request is not upgraded
+	removeHopHeaders(h, false)
+	assert.Equal(http.Header{}, h)
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	assert := assert.New(t)
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://example.com:8080/", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("X-Forwarded-Host", "spoofed.com")
+		req.Header.Set("X-Real-Ip", "10.0.0.1")
+		req.Header.Set("Forwarded", "for=10.0.0.1")
+		return req
+	}
+
+	req := newRequest()
+	setForwardedHeaders(req, "192.0.2.1", "https", false)
+	assert.Equal("192.0.2.1", req.Header.Get("X-Forwarded-For"))
+	assert.Equal("example.com:8080", req.Header.Get("X-Forwarded-Host"))
+	assert.Equal("https", req.Header.Get("X-Forwarded-Proto"))
+	assert.Equal("192.0.2.1", req.Header.Get("X-Real-Ip"))
+	assert.Equal(`for=192.0.2.1;host="example.com:8080";proto=https`, req.Header.Get("Forwarded"))
+
+	req = newRequest()
+	setForwardedHeaders(req, "2001:db8::1", "http", true)
+	assert.Equal("10.0.0.1, 2001:db8::1", req.Header.Get("X-Forwarded-For"))
+	assert.Equal("spoofed.com", req.Header.Get("X-Forwarded-Host"))
+	assert.Equal("http", req.Header.Get("X-Forwarded-Proto"))
+	assert.Equal("10.0.0.1", req.Header.Get("X-Real-Ip"))
+	assert.Equal(`for=10.0.0.1, for="[2001:db8::1]";host="example.com:8080";proto=http`, req.Header.Get("Forwarded"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat is the configuration of pings sent to the peer of a connection.
+type Heartbeat struct {
+	// Interval is the time between pings.
+	Interval time.Duration
+	// MaxMissed is the number of pings in a row without pong before the
+	// peer is considered dead, 0 means no limit.
+	MaxMissed int
+}
+
+// keepAlive pings the peer every Heartbeat.Interval until the connection is
+// closed. The connection is closed if the peer misses too many pings, so a
+// half-open connection is detected by the reader of it.
+func (a *Agent) keepAlive() {
+	if a.Heartbeat.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.Heartbeat.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n := atomic.LoadInt32(&a.unanswered)
+		if max := a.Heartbeat.MaxMissed; max > 0 && int(n) >= max {
+			log.Warnf("%s missed %d heartbeats, closing the connection", a, n)
+			a.conn.Close()
+			return
+		}
+		atomic.AddInt32(&a.unanswered, 1)
+		ping := PingMessage{Data: strconv.FormatInt(time.Now().UnixNano(), 10)}
+		if a.SendMessage(ping) != nil {
+			return
+		}
+	}
+}
+
+// handleHeartbeat answers pings and records the round-trip time of pongs,
+// it reports whether msg is a heartbeat message.
+func (a *Agent) handleHeartbeat(msg Transferable) bool {
+	switch m := msg.(type) {
+	case PingMessage:
+		a.SendMessage(PongMessage{Data: m.Data})
+	case PongMessage:
+		if sent, err := strconv.ParseInt(m.Data, 10, 64); err == nil {
+			atomic.StoreInt64(&a.rtt, int64(time.Since(time.Unix(0, sent))))
+		}
+		atomic.StoreInt32(&a.unanswered, 0)
+	default:
+		return false
+	}
+	return true
+}
+
+// RTT returns the round-trip time of the last heartbeat, it is 0 before any
+// pong is received.
+func (a *Agent) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.rtt))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+	hb := Heartbeat{Interval: time.Millisecond * 20, MaxMissed: 2}
+	b := &Broker{Token: "test-token", Heartbeat: hb}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: "127.0.0.1:1"}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	agent := NewAgent("test-agent")
+	agent.Heartbeat = hb
+	if err := agent.Dial(addr, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	go agent.Serve()
+	defer agent.closeConn()
+	waitRoute(t, b, "test.host")
+
+	time.Sleep(hb.Interval * 10)
+	tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+	if assert.Nil(err, "agent answering pings is offline") {
+		assert.True(tf.agent.RTT() > 0)
+		tf.Close()
+	}
+	assert.True(agent.RTT() > 0)
+}
+
+func TestHeartbeatDeadAgent(t *testing.T) {
+	b := &Broker{Token: "test-token", Heartbeat: Heartbeat{Interval: time.Millisecond * 20, MaxMissed: 2}}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: "127.0.0.1:1"}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	// the fake agent never answers pings
+	startFakeAgent(t, addr, func(r io.Reader, w io.Writer) {})
+	waitRoute(t, b, "test.host")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		tf, err := b.CreateTransferer("test.host", "/", "127.0.0.1")
+		if err != nil {
+			assert.Equal(t, HErrAgentNotOnline, err)
+			return
+		}
+		tf.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("dead agent is still online")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
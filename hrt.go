@@ -1,46 +1,83 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type (
 	BrokerConf struct {
-		listen string
-		http   string
-		route  string
-		token  string
+		listen  string
+		http    string
+		https   string
+		route   string
+		token   string
+		creds   string
+		dupID   string
+		balance string
+		// tcp and udp are the tunnels, see ParseTunnel
+		tcp, udp []string
+		udpIdle  time.Duration
+		// tcpProxy is the PROXY protocol version of tcp tunnels
+		tcpProxy int
+		// acceptProxy requires PROXY protocol on the public listeners
+		acceptProxy bool
+
+		// routeReload is the interval to check the route file
+		routeReload time.Duration
+		// shutdownGrace is the time to wait for in-flight transfers
+		shutdownGrace time.Duration
+		heartbeat     Heartbeat
+
+		tlsCert, tlsKey, tlsClientCA string
+		httpsCerts                   string
+		// errorPage is the template file of error pages
+		errorPage string
 	}
 	AgentConf struct {
-		addr  string
+		// addrs are the addresses of brokers, the next one is used when a
+		// broker can not be connected or goes away
+		addrs []string
 		token string
 		id    string
+		group string
+		// expose are the routes to register, in the form of host=address
+		expose []string
+
+		// drainTimeout is the time to wait for local connections on shutdown
+		drainTimeout time.Duration
+		heartbeat    Heartbeat
+
+		reconnect bool
+		backoff   Backoff
+
+		tls                bool
+		tlsCA              string
+		tlsCert, tlsKey    string
+		insecureSkipVerify bool
 	}
 )
 
 var log *zap.SugaredLogger
 
-// var exit = make(chan struct{})
-
 func init() {
-	// exch := make(chan os.Signal, 1)
-	// go func() {
-	// 	<-exch
-	// 	signal.Stop(exch)
-	// 	close(exch)
-	// 	close(exit)
-	// }()
-	// signal.Notify(exch, syscall.SIGINT)
-
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "initialize logger failed: %s", err)
 		os.Exit(1)
 	}
 	log = logger.Sugar()
+
+	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
@@ -51,32 +88,226 @@ func main() {
 }
 
 func StartBroker(conf BrokerConf) {
-	b := Broker{Token: conf.token}
+	b := Broker{Token: conf.token, DuplicateID: conf.dupID, Balance: conf.balance}
 	b.Init()
 
+	if !validBalance(conf.balance) {
+		log.Fatalf("unknown balance strategy %q", conf.balance)
+	}
+
+	switch conf.dupID {
+	case DupReject, DupReplace, DupBalance:
+	default:
+		log.Fatalf("unknown duplicate id policy %q", conf.dupID)
+	}
+
+	if conf.creds != "" {
+		creds, err := ReadCredentials(conf.creds)
+		if err != nil {
+			log.Fatal("read credentials file: ", err)
+		}
+		if conf.token != "" {
+			log.Warn("--token is ignored since --credentials is set")
+		}
+		b.Credentials = creds
+		log.Infof("loaded the credentials of %d agents from %s", len(creds), conf.creds)
+	}
+
+	if conf.tlsCert != "" || conf.tlsKey != "" {
+		tlsConf, err := LoadServerTLSConfig(conf.tlsCert, conf.tlsKey, conf.tlsClientCA)
+		if err != nil {
+			log.Fatal("load tls config: ", err)
+		}
+		b.TLSConfig = tlsConf
+	} else if conf.tlsClientCA != "" {
+		log.Fatal("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if conf.https != "" {
+		if conf.httpsCerts == "" {
+			log.Fatal("--https requires --https-certs")
+		}
+		certs, err := LoadCertDir(conf.httpsCerts)
+		if err != nil {
+			log.Fatal("load https certificates: ", err)
+		}
+		b.HTTPSConfig = certs.TLSConfig()
+	}
+
+	if conf.errorPage != "" {
+		page, err := LoadErrorPage(conf.errorPage)
+		if err != nil {
+			log.Fatal("load error page: ", err)
+		}
+		b.ErrorPage = page
+	}
+
 	if conf.route != "" {
-		route, err := ReadJsonRoute(conf.route)
+		route, err := ReadRoute(conf.route)
 		if err != nil {
 			log.Fatal("read route file: ", err)
 		}
 		b.route = route
 		log.Info("successfully loaded the routing information from ", conf.route)
-		for host, record := range route {
-			log.Debugf("route: %s => %s[%s]", host, record.AgentID, record.Host)
+		logRoute(route)
+
+		w := RouteWatcher{
+			Filename: conf.route,
+			Interval: conf.routeReload,
+			OnChange: func(route Route) {
+				b.SetRoute(route)
+				logRoute(route)
+			},
 		}
+		go w.Watch(nil)
+	}
+
+	if conf.tcpProxy < 0 || conf.tcpProxy > 2 {
+		log.Fatalf("unknown PROXY protocol version %d", conf.tcpProxy)
+	}
+	b.TCPTunnels = parseTunnels("tcp", conf.tcp)
+	for addr, route := range b.TCPTunnels {
+		route.ProxyProtocol = conf.tcpProxy
+		b.TCPTunnels[addr] = route
 	}
+	b.AcceptProxyProtocol = conf.acceptProxy
+	b.UDPTunnels = parseTunnels("udp", conf.udp)
+	b.UDPIdleTimeout = conf.udpIdle
 
-	err := b.Serve(conf.listen, conf.http)
+	b.ShutdownGrace = conf.shutdownGrace
+	b.Heartbeat = conf.heartbeat
+	b.done = notifyShutdown()
+
+	err := b.Serve(conf.listen, conf.http, conf.https)
 	if err != nil {
 		log.Error("start broker: ", err)
 	}
 }
 
+// notifyShutdown returns a channel which is closed on SIGINT or SIGTERM. A
+// second signal exits immediately.
+func notifyShutdown() <-chan struct{} {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		log.Infof("%s received, shutting down", <-sig)
+		close(done)
+		log.Warnf("%s received again, exit now", <-sig)
+		os.Exit(1)
+	}()
+	return done
+}
+
+func parseTunnels(network string, values []string) map[string]RouteRecord {
+	tunnels := make(map[string]RouteRecord)
+	for _, s := range values {
+		addr, route, err := ParseTunnel(network, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := tunnels[addr]; ok {
+			log.Fatalf("duplicate %s tunnel %s", network, addr)
+		}
+		tunnels[addr] = route
+	}
+	return tunnels
+}
+
+func logRoute(route Route) {
+	for host, record := range route {
+		log.Debugf("route: %s => %s[%s]", host, strings.Join(record.AgentIDs, ","), record.Host)
+	}
+}
+
 func StartAgent(conf AgentConf) {
-	agent := NewAgent(conf.id)
-	err := agent.Connect(conf.addr, conf.token)
+	var tlsConf *tls.Config
+	if conf.tls || conf.tlsCA != "" || conf.insecureSkipVerify || conf.tlsCert != "" {
+		var err error
+		tlsConf, err = LoadClientTLSConfig(conf.tlsCA, conf.insecureSkipVerify, conf.tlsCert, conf.tlsKey)
+		if err != nil {
+			log.Fatal("load tls config: ", err)
+		}
+	}
+
+	expose, err := parseExpose(conf.expose)
 	if err != nil {
-		log.Error("connect to broker: ", err)
-		return
+		log.Fatal(err)
+	}
+
+	runAgent(conf, tlsConf, expose, notifyShutdown())
+}
+
+// runAgent connects to the brokers of conf in turn and serves until shutdown
+// is closed, or until a connection ends and reconnecting is disabled. The
+// next broker is tried when a broker can not be connected or goes away.
+func runAgent(conf AgentConf, tlsConf *tls.Config, expose map[string]string, shutdown <-chan struct{}) {
+	for i := 0; ; {
+		addr := conf.addrs[i%len(conf.addrs)]
+		log.Info("connecting to broker ", addr)
+		agent := NewAgent(conf.id)
+		agent.Group = conf.group
+		agent.TLSConfig = tlsConf
+		agent.Expose = expose
+		agent.DrainTimeout = conf.drainTimeout
+		agent.Heartbeat = conf.heartbeat
+		err := agent.Dial(addr, conf.token)
+		if err == nil {
+			log.Infof("authenticated to broker %s as %s", addr, conf.id)
+			for host, local := range expose {
+				log.Infof("exposed %s => %s", host, local)
+			}
+			conf.backoff.Reset()
+			served := make(chan struct{})
+			go func() {
+				select {
+				case <-shutdown:
+					agent.Close()
+				case <-served:
+				}
+			}()
+			err = agent.Serve()
+			close(served)
+			agent.closeConn()
+			if err == nil {
+				log.Info("agent closed")
+				return
+			}
+			log.Info("disconnected from broker: ", err)
+			if err == ErrBrokerGoAway {
+				i++
+			}
+		} else {
+			log.Error("connect to broker: ", err)
+			i++
+		}
+
+		if !conf.reconnect {
+			return
+		}
+		delay := conf.backoff.Next()
+		log.Infof("reconnect in %s", delay)
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// parseExpose parses the values of --expose which are in the form of
+// host=address.
+func parseExpose(values []string) (map[string]string, error) {
+	expose := make(map[string]string)
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 || i == len(v)-1 {
+			return nil, fmt.Errorf("invalid --expose %q, want host=address", v)
+		}
+		if _, _, err := net.SplitHostPort(v[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid address of --expose %q: %s", v, err)
+		}
+		expose[v[:i]] = v[i+1:]
 	}
+	return expose, nil
 }
@@ -2,18 +2,33 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
 )
 
 var (
 	HErrAgentNotOnline = HTTPError{503, "Agent Offline", "agent not online"}
 	HErrNoRouteRecort  = HTTPError{404, "Not Found", "no such route record"}
+
+	HErrUnauthorized    = HTTPError{401, "Unauthorized", "authorization required"}
+	HErrTooManyRequests = HTTPError{429, "Too Many Requests", "rate limit exceeded"}
+	HErrShuttingDown    = HTTPError{503, "Service Unavailable", "broker is shutting down"}
+
+	HErrBadGateway      = HTTPError{502, "Bad Gateway", "upstream is unavailable"}
+	HErrGatewayTimeout  = HTTPError{504, "Gateway Timeout", "upstream timeout"}
+	HErrRequestTooLarge = HTTPError{413, "Payload Too Large", "request body too large"}
 )
 
-const httpErrorTmpl = `<!DOCTYPE html><html><head><title>hrt error</title></head><body>
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html><html><head><title>hrt error</title></head><body>
 <h1>hrt error</h1>
-<p>%s</p>
-</body></html>`
+<p>{{.Content}}</p>
+</body></html>`))
 
 type HTTPError struct {
 	Status  int
@@ -21,15 +36,93 @@ type HTTPError struct {
 	Content string
 }
 
+// ErrorContext describes the request an HTTPError is written for, the
+// fields other than JSON and Page are available in error page templates
+// along with the fields of HTTPError.
+type ErrorContext struct {
+	// JSON writes the error as JSON instead of an HTML page.
+	JSON bool
+	// Page is the template of HTML error pages, a default page is used if
+	// it is nil.
+	Page *template.Template
+
+	Route     string
+	AgentID   string
+	RequestID string
+}
+
+// errorPageData is the data of error page templates.
+type errorPageData struct {
+	HTTPError
+	ErrorContext
+}
+
 func (e HTTPError) Error() string {
 	return e.Content
 }
 
-func (e HTTPError) Write(w *bufio.Writer) {
-	msg := fmt.Sprintf(httpErrorTmpl, e.Content)
+func (e HTTPError) Write(w *bufio.Writer, ctx ErrorContext) {
+	var body []byte
+	contentType := "text/html; charset=utf-8"
+	if ctx.JSON {
+		contentType = "application/json"
+		body, _ = json.Marshal(struct {
+			Status    int    `json:"status"`
+			Message   string `json:"message"`
+			Error     string `json:"error"`
+			Route     string `json:"route,omitempty"`
+			AgentID   string `json:"agentId,omitempty"`
+			RequestID string `json:"requestId,omitempty"`
+		}{e.Status, e.Message, e.Content, ctx.Route, ctx.AgentID, ctx.RequestID})
+	} else {
+		var buf bytes.Buffer
+		data := errorPageData{e, ctx}
+		if ctx.Page == nil || ctx.Page.Execute(&buf, data) != nil {
+			buf.Reset()
+			defaultErrorPage.Execute(&buf, data)
+		}
+		body = buf.Bytes()
+	}
+
 	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", e.Status, e.Message)
-	fmt.Fprintf(w, "Content-Length: %d\r\n", len(msg))
+	fmt.Fprintf(w, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(body))
+	if ctx.RequestID != "" {
+		fmt.Fprintf(w, "X-Request-Id: %s\r\n", ctx.RequestID)
+	}
+	// the connection is always closed after an error
+	w.WriteString("Connection: close\r\n")
+	if e.Status == 401 {
+		w.WriteString("WWW-Authenticate: Basic realm=\"hrt\"\r\n")
+	}
 	w.WriteString("\r\n")
-	w.WriteString(msg)
+	w.Write(body)
 	w.Flush()
 }
+
+// LoadErrorPage loads an HTML error page template. The template can use
+// {{.Status}}, {{.Message}}, {{.Content}}, {{.Route}}, {{.AgentID}} and
+// {{.RequestID}}.
+func LoadErrorPage(filename string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filename).Parse(string(data))
+}
+
+// acceptsJSON reports whether the client prefers JSON over HTML.
+func acceptsJSON(req *http.Request) bool {
+	json := false
+	for _, v := range req.Header["Accept"] {
+		for _, s := range strings.Split(v, ",") {
+			switch mt, _, _ := mime.ParseMediaType(s); mt {
+			case "text/html":
+				return false
+			case "application/json":
+				json = true
+			}
+		}
+	}
+	return json
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeHTTPError(t *testing.T, e HTTPError, ctx ErrorContext) (*http.Response, string) {
+	var buf bytes.Buffer
+	e.Write(bufio.NewWriter(&buf), ctx)
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestHTTPErrorWrite(t *testing.T) {
+	assert := assert.New(t)
+	ctx := ErrorContext{Route: "example.com/api", AgentID: "agent-a", RequestID: "0123456789abcdef"}
+
+	resp, body := writeHTTPError(t, HErrBadGateway, ctx)
+	assert.Equal(502, resp.StatusCode)
+	assert.Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal("0123456789abcdef", resp.Header.Get("X-Request-Id"))
+	assert.True(resp.Close)
+	assert.Contains(body, "upstream is unavailable")
+
+	ctx.Page = template.Must(template.New("").Parse(
+		"<p>{{.Status}} {{.Message}} {{.Route}} {{.AgentID}} {{.RequestID}} {{.Content}}</p>"))
+	_, body = writeHTTPError(t, HErrBadGateway, ctx)
+	assert.Equal("<p>502 Bad Gateway example.com/api agent-a 0123456789abcdef upstream is unavailable</p>", body)
+
+	// the default page is used if the template fails
+	ctx.Page = template.Must(template.New("").Parse("{{.Unknown}}"))
+	_, body = writeHTTPError(t, HErrBadGateway, ctx)
+	assert.Contains(body, "upstream is unavailable")
+
+	ctx.JSON = true
+	resp, body = writeHTTPError(t, HErrGatewayTimeout, ctx)
+	assert.Equal(504, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	var v map[string]interface{}
+	if assert.Nil(json.Unmarshal([]byte(body), &v)) {
+		assert.Equal(map[string]interface{}{
+			"status":    504.0,
+			"message":   "Gateway Timeout",
+			"error":     "upstream timeout",
+			"route":     "example.com/api",
+			"agentId":   "agent-a",
+			"requestId": "0123456789abcdef",
+		}, v)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                    false,
+		"*/*":                                 false,
+		"application/json":                    true,
+		"application/json; charset=utf-8":     true,
+		"text/plain, application/json;q=0.9":  true,
+		"text/html,application/xhtml+xml,*/*": false,
+		"text/html, application/json":         false,
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		assert.Equal(t, want, acceptsJSON(req), accept)
+	}
+}
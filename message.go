@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"time"
 	"unsafe"
 )
 
@@ -17,6 +19,8 @@ type Transferable interface {
 type (
 	AuthMessage struct {
 		ID, Token string
+		// Group is optional
+		Group string
 	}
 	TextMessage struct {
 		Content string
@@ -30,24 +34,104 @@ type (
 	}
 	FirstDataMessage struct {
 		DataMessage
+		// Host is the upstream address, it is prefixed with "udp://" for
+		// udp tunnels.
 		Host string
+		// ConnectTimeout limits the time to connect to Host, the default
+		// timeout of agent is used if it is 0.
+		ConnectTimeout time.Duration
+		// ClientAddr is the address of the client seen by broker.
+		ClientAddr string
+		// ProxyProtocol is the version of the PROXY protocol header sent
+		// to Host before the data, 0 means no header.
+		ProxyProtocol int
 	}
 	LastDataMessage struct {
 		DataMessage
 		Err string
 	}
+	WindowUpdateMessage struct {
+		TID  string
+		Size int
+	}
+	// GoAwayMessage tells the peer the sender is shutting down, no new
+	// transfers should be started on the connection.
+	GoAwayMessage struct {
+		Reason string
+	}
+	// PingMessage is sent periodically by both sides to check the peer is
+	// alive, Data is echoed back by a PongMessage.
+	PingMessage struct {
+		Data string
+	}
+	PongMessage struct {
+		Data string
+	}
+	// RegisterMessage is sent by an agent after it is authenticated, Routes
+	// maps the hosts it exposes to local addresses.
+	RegisterMessage struct {
+		Routes map[string]string
+	}
 )
 
 type MessageReader struct {
 	rd *bufio.Reader
 }
 
-var ErrInvalidMessage = errors.New("invalid message format")
+var (
+	ErrInvalidMessage  = errors.New("invalid message format")
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// Limits of received messages, so a peer can not make the reader allocate
+// arbitrary memory, even before it is authenticated. No data frame is larger
+// than InitialWindowSize since it is sent within the window, and datagrams
+// are smaller still.
+const (
+	maxLineSize  = 64 * 1024
+	maxFrameSize = InitialWindowSize
+)
 
 func NewMessageReader(rd io.Reader) *MessageReader {
 	return &MessageReader{rd: bufio.NewReader(rd)}
 }
 
+// errString converts err to the error string carried by a LastDataMessage,
+// io.EOF means the transfer ended normally and is converted to "".
+func errString(err error) string {
+	if err == nil || err == io.EOF {
+		return ""
+	}
+	return err.Error()
+}
+
+// remoteError converts the error string of a LastDataMessage back to an
+// error, see errString.
+func remoteError(s string) error {
+	switch s {
+	case "":
+		return io.EOF
+	case ErrConnectTimeout.Error():
+		return ErrConnectTimeout
+	}
+	return errors.New(s)
+}
+
+// readLine reads until the first LF, including it.
+func (r *MessageReader) readLine() (line []byte, err error) {
+	for {
+		var frag []byte
+		frag, err = r.rd.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineSize {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
 func str(p []byte) string { return *(*string)(unsafe.Pointer(&p)) }
 
 func (r *MessageReader) Read() (Transferable, error) {
@@ -58,49 +142,92 @@ func (r *MessageReader) Read() (Transferable, error) {
 
 	switch firstch {
 	case '@':
-		line, err := r.rd.ReadBytes('\n')
+		line, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
 		sp := bytes.Split(line[:len(line)-1], []byte{' '})
-		if len(sp) != 2 {
+		switch len(sp) {
+		case 2:
+			return AuthMessage{ID: str(sp[0]), Token: str(sp[1])}, nil
+		case 3:
+			return AuthMessage{ID: str(sp[0]), Token: str(sp[1]), Group: str(sp[2])}, nil
+		default:
 			return nil, ErrInvalidMessage
 		}
-		return AuthMessage{ID: str(sp[0]), Token: str(sp[1])}, nil
 
 	case '+':
-		text, err := r.rd.ReadBytes('\n')
+		text, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
 		return TextMessage{Content: str(text[:len(text)-1])}, nil
 
 	case '-':
-		text, err := r.rd.ReadBytes('\n')
+		text, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
 		return ErrorMessage{Content: str(text[:len(text)-1])}, nil
 
+	case '!':
+		reason, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return GoAwayMessage{Reason: str(reason[:len(reason)-1])}, nil
+
+	case '>':
+		data, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return PingMessage{Data: str(data[:len(data)-1])}, nil
+
+	case '<':
+		data, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return PongMessage{Data: str(data[:len(data)-1])}, nil
+
 	case '=':
 		return r.readDataMessage()
 
 	case '[':
-		host, err := r.rd.ReadBytes('\n')
+		line, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
-		dm, err := r.readDataMessage()
-		if err != nil {
+		var m FirstDataMessage
+		fields := bytes.Split(line[:len(line)-1], []byte{' '})
+		m.Host = str(fields[0])
+		// unknown parameters are ignored, so new ones can be added
+		for _, field := range fields[1:] {
+			i := bytes.IndexByte(field, '=')
+			if i <= 0 {
+				return nil, ErrInvalidMessage
+			}
+			switch str(field[:i]) {
+			case "connect":
+				if m.ConnectTimeout, err = time.ParseDuration(str(field[i+1:])); err != nil {
+					return nil, ErrInvalidMessage
+				}
+			case "client":
+				m.ClientAddr = str(field[i+1:])
+			case "proxy":
+				if m.ProxyProtocol, err = strconv.Atoi(str(field[i+1:])); err != nil {
+					return nil, ErrInvalidMessage
+				}
+			}
+		}
+		if m.DataMessage, err = r.readDataMessage(); err != nil {
 			return nil, err
 		}
-		return FirstDataMessage{
-			Host:        str(host[:len(host)-1]),
-			DataMessage: dm,
-		}, nil
+		return m, nil
 
 	case ']':
-		errstr, err := r.rd.ReadBytes('\n')
+		errstr, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
@@ -113,13 +240,43 @@ func (r *MessageReader) Read() (Transferable, error) {
 			DataMessage: dm,
 		}, nil
 
+	case '^':
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		sp := bytes.Split(line[:len(line)-1], []byte{' '})
+		if len(sp) != 2 {
+			return nil, ErrInvalidMessage
+		}
+		size, err := strconv.Atoi(str(sp[1]))
+		if err != nil || size <= 0 {
+			return nil, ErrInvalidMessage
+		}
+		return WindowUpdateMessage{TID: str(sp[0]), Size: size}, nil
+
+	case '*':
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		m := RegisterMessage{Routes: make(map[string]string)}
+		for _, field := range bytes.Fields(line) {
+			i := bytes.IndexByte(field, '=')
+			if i <= 0 || i == len(field)-1 {
+				return nil, ErrInvalidMessage
+			}
+			m.Routes[string(field[:i])] = string(field[i+1:])
+		}
+		return m, nil
+
 	default:
 		return nil, errors.New("unknown message type")
 	}
 }
 
 func (r *MessageReader) readDataMessage() (m DataMessage, err error) {
-	line, err := r.rd.ReadBytes('\n')
+	line, err := r.readLine()
 	if err != nil {
 		return
 	}
@@ -134,6 +291,10 @@ func (r *MessageReader) readDataMessage() (m DataMessage, err error) {
 		err = fmt.Errorf("parse len(data) of data message: %s", err)
 		return
 	}
+	if dlenn > maxFrameSize {
+		err = ErrMessageTooLarge
+		return
+	}
 	if dlenn > 0 {
 		m.Data = make([]byte, dlenn)
 		_, err = io.ReadFull(r.rd, m.Data)
@@ -144,9 +305,13 @@ func (r *MessageReader) readDataMessage() (m DataMessage, err error) {
 	return
 }
 
-// '@' agent-id SP token LF
+// '@' agent-id SP token [SP group] LF
 func (m AuthMessage) Bytes() []byte {
-	bytes := make([]byte, len(m.ID)+len(m.Token)+3)
+	size := len(m.ID) + len(m.Token) + 3
+	if m.Group != "" {
+		size += len(m.Group) + 1
+	}
+	bytes := make([]byte, size)
 	var n int
 
 	bytes[n] = '@'
@@ -157,6 +322,11 @@ func (m AuthMessage) Bytes() []byte {
 	n++
 
 	n += copy(bytes[n:], m.Token)
+	if m.Group != "" {
+		bytes[n] = ' '
+		n++
+		n += copy(bytes[n:], m.Group)
+	}
 	bytes[n] = '\n'
 	return bytes
 }
@@ -179,6 +349,33 @@ func (m ErrorMessage) Bytes() []byte {
 	return bytes
 }
 
+// '!' reason LF
+func (m GoAwayMessage) Bytes() []byte {
+	bytes := make([]byte, len(m.Reason)+2)
+	bytes[0] = '!'
+	copy(bytes[1:], m.Reason)
+	bytes[len(bytes)-1] = '\n'
+	return bytes
+}
+
+// '>' data LF
+func (m PingMessage) Bytes() []byte {
+	bytes := make([]byte, len(m.Data)+2)
+	bytes[0] = '>'
+	copy(bytes[1:], m.Data)
+	bytes[len(bytes)-1] = '\n'
+	return bytes
+}
+
+// '<' data LF
+func (m PongMessage) Bytes() []byte {
+	bytes := make([]byte, len(m.Data)+2)
+	bytes[0] = '<'
+	copy(bytes[1:], m.Data)
+	bytes[len(bytes)-1] = '\n'
+	return bytes
+}
+
 // '=' tid SP data-length LF data
 func (m DataMessage) Bytes() []byte {
 	dlen := strconv.Itoa(len(m.Data))
@@ -200,16 +397,28 @@ func (m DataMessage) Bytes() []byte {
 	return bytes
 }
 
-// '[' host LF tid SP data-length LF data
+// '[' host *(SP param) LF tid SP data-length LF data
+//
+// param is key=value, such as connect=5s.
 func (m FirstDataMessage) Bytes() []byte {
+	host := m.Host
+	if m.ConnectTimeout > 0 {
+		host += " connect=" + m.ConnectTimeout.String()
+	}
+	if m.ClientAddr != "" {
+		host += " client=" + m.ClientAddr
+	}
+	if m.ProxyProtocol > 0 {
+		host += " proxy=" + strconv.Itoa(m.ProxyProtocol)
+	}
 	dlen := strconv.Itoa(len(m.Data))
-	bytes := make([]byte, len(m.Host)+len(m.TID)+len(dlen)+len(m.Data)+4)
+	bytes := make([]byte, len(host)+len(m.TID)+len(dlen)+len(m.Data)+4)
 	var i int
 
 	bytes[i] = '['
 	i++
 
-	i += copy(bytes[i:], m.Host)
+	i += copy(bytes[i:], host)
 	bytes[i] = '\n'
 	i++
 
@@ -249,3 +458,43 @@ func (m LastDataMessage) Bytes() []byte {
 	copy(bytes[i:], m.Data)
 	return bytes
 }
+
+// '^' tid SP size LF
+func (m WindowUpdateMessage) Bytes() []byte {
+	size := strconv.Itoa(m.Size)
+	bytes := make([]byte, len(m.TID)+len(size)+3)
+	var i int
+
+	bytes[i] = '^'
+	i++
+
+	i += copy(bytes[i:], m.TID)
+	bytes[i] = ' '
+	i++
+
+	i += copy(bytes[i:], size)
+	bytes[i] = '\n'
+	return bytes
+}
+
+// '*' host '=' address *(SP host '=' address) LF
+func (m RegisterMessage) Bytes() []byte {
+	hosts := make([]string, 0, len(m.Routes))
+	for host := range m.Routes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var buf bytes.Buffer
+	buf.WriteByte('*')
+	for i, host := range hosts {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(host)
+		buf.WriteByte('=')
+		buf.WriteString(m.Routes[host])
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,6 +19,11 @@ func TestEncodeAuthMessage(t *testing.T) {
 	assert.Equal(t, bytes, m.Bytes())
 }
 
+func TestEncodeAuthMessageWithGroup(t *testing.T) {
+	m := AuthMessage{ID: "test-ID", Token: "test-token", Group: "test-group"}
+	assert.Equal(t, []byte("@test-ID test-token test-group\n"), m.Bytes())
+}
+
 func TestEncodeTextMessage(t *testing.T) {
 	m := TextMessage{Content: "blahblahblah"}
 	bytes := []byte("+" + m.Content + "\n")
@@ -49,6 +56,11 @@ func TestEncodeFirstDataMessage(t *testing.T) {
 	assert.Equal(t, bytes, m.Bytes())
 }
 
+func TestEncodeWindowUpdateMessage(t *testing.T) {
+	m := WindowUpdateMessage{TID: "test-tid", Size: 65536}
+	assert.Equal(t, []byte("^test-tid 65536\n"), m.Bytes())
+}
+
 func TestParseAuthMessage(t *testing.T) {
 	msg := AuthMessage{Token: "test-token", ID: "test-id"}
 	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
@@ -57,6 +69,14 @@ func TestParseAuthMessage(t *testing.T) {
 	assert.Equal(t, msg, msg2)
 }
 
+func TestParseAuthMessageWithGroup(t *testing.T) {
+	msg := AuthMessage{Token: "test-token", ID: "test-id", Group: "test-group"}
+	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+}
+
 func TestParseTextMessage(t *testing.T) {
 	msg := TextMessage{Content: "something good!"}
 	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
@@ -84,6 +104,23 @@ func TestParseDataMessage(t *testing.T) {
 	assert.Equal(t, msg, msg2)
 }
 
+func TestReadMessageTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []string{
+		"=x 4611686018427387904\n",
+		fmt.Sprintf("=x %d\n", maxFrameSize+1),
+		"+" + strings.Repeat("x", maxLineSize) + "\n",
+	} {
+		_, err := NewMessageReader(strings.NewReader(s)).Read()
+		assert.Equal(ErrMessageTooLarge, err)
+	}
+
+	msg := DataMessage{TID: "x", Data: make([]byte, maxFrameSize)}
+	msg2, err := NewMessageReader(bytes.NewReader(msg.Bytes())).Read()
+	assert.Nil(err)
+	assert.Equal(msg, msg2)
+}
+
 func TestReadFirstDataMessage(t *testing.T) {
 	assert := assert.New(t)
 	msg := FirstDataMessage{
@@ -98,4 +135,72 @@ func TestReadFirstDataMessage(t *testing.T) {
 	assert.Nil(err)
 	assert.IsType(FirstDataMessage{}, msg2)
 	assert.Equal(msg, msg2)
+
+	msg.ConnectTimeout = time.Second * 5
+	assert.Contains(string(msg.Bytes()), "[www.114514.com connect=5s\n")
+	r = NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err = r.Read()
+	assert.Nil(err)
+	assert.Equal(msg, msg2)
+
+	msg.ClientAddr = "[2001:db8::1]:4321"
+	msg.ProxyProtocol = 2
+	assert.Contains(string(msg.Bytes()), "[www.114514.com connect=5s client=[2001:db8::1]:4321 proxy=2\n")
+	r = NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err = r.Read()
+	assert.Nil(err)
+	assert.Equal(msg, msg2)
+
+	// unknown parameters are ignored
+	r = NewMessageReader(bytes.NewReader([]byte("[www.114514.com x=1\ntest-tid 0\n")))
+	msg2, err = r.Read()
+	assert.Nil(err)
+	assert.Equal("www.114514.com", msg2.(FirstDataMessage).Host)
+}
+
+func TestParseWindowUpdateMessage(t *testing.T) {
+	msg := WindowUpdateMessage{TID: "test-tid", Size: 131072}
+	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+}
+
+func TestParseRegisterMessage(t *testing.T) {
+	msg := RegisterMessage{Routes: map[string]string{
+		"a.example.com":     "127.0.0.1:8000",
+		"b.example.com/api": "localhost:9000",
+	}}
+	assert.Equal(t, "*a.example.com=127.0.0.1:8000 b.example.com/api=localhost:9000\n", string(msg.Bytes()))
+	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+
+	r = NewMessageReader(bytes.NewReader([]byte("*a.example.com\n")))
+	_, err = r.Read()
+	assert.Equal(t, ErrInvalidMessage, err)
+}
+
+func TestParseGoAwayMessage(t *testing.T) {
+	msg := GoAwayMessage{Reason: "broker is shutting down"}
+	assert.Equal(t, "!broker is shutting down\n", string(msg.Bytes()))
+	r := NewMessageReader(bytes.NewReader(msg.Bytes()))
+	msg2, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+}
+
+func TestParseHeartbeatMessage(t *testing.T) {
+	for _, msg := range []Transferable{
+		PingMessage{Data: "1600000000000000000"},
+		PongMessage{Data: "1600000000000000000"},
+	} {
+		r := NewMessageReader(bytes.NewReader(msg.Bytes()))
+		msg2, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, msg, msg2)
+	}
+	assert.Equal(t, ">1\n", string(PingMessage{Data: "1"}.Bytes()))
+	assert.Equal(t, "<1\n", string(PongMessage{Data: "1"}.Bytes()))
 }
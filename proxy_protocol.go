@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PROXY protocol tells a server the address of the client connected to a
+// proxy, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyHeaderTimeout limits the time to read a PROXY protocol header.
+const proxyHeaderTimeout = time.Second * 10
+
+// maxProxyV1Len is the maximum length of a version 1 header, including the
+// CRLF.
+const maxProxyV1Len = 107
+
+// proxyHeader returns the PROXY protocol header of the given version for a
+// connection from src to dst. The addresses are reported as unknown if src is
+// not a TCP address, and dst is replaced by the unspecified address if it is
+// not of the same family as src.
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	known := s != nil
+	ipv4 := known && s.IP.To4() != nil
+	if known && (d == nil || (d.IP.To4() != nil) != ipv4) {
+		d = &net.TCPAddr{IP: net.IPv6unspecified}
+		if ipv4 {
+			d.IP = net.IPv4zero
+		}
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Sig)
+	if !known {
+		// LOCAL command, the receiver uses the real connection endpoints
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	srcIP, dstIP, family := s.IP.To16(), d.IP.To16(), byte(0x21)
+	if ipv4 {
+		srcIP, dstIP, family = s.IP.To4(), d.IP.To4(), 0x11
+	}
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(len(srcIP)*2+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
+
+// parseTCPAddr parses a literal TCP address, it returns nil if addr is
+// invalid.
+func parseTCPAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 from r,
+// and returns the source address in it. The address is nil if the header
+// does not carry one, such as "PROXY UNKNOWN".
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if p, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(p, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	p, err := r.Peek(len(proxyV2Sig) + 4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p[:len(proxyV2Sig)], proxyV2Sig) {
+		return nil, ErrProxyHeader
+	}
+	return readProxyV2(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Len {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, c); c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// only the PROXY command over TCP carries the client address, the
+	// others, such as LOCAL, are health checks of the proxy itself
+	if hdr[12]&0xf != 1 {
+		return nil, nil
+	}
+	var ipLen int
+	switch hdr[13] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, ErrProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := binary.BigEndian.Uint16(body[ipLen*2:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxyListener accepts connections starting with a PROXY protocol header,
+// it is used behind a load balancer. The header is required, connections
+// without it are failed on read.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY protocol header on the first Read or
+// RemoteAddr, so a slow client does not block the accepting loop. The
+// remote address is the client address in the header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		var src net.Addr
+		if src, c.err = readProxyHeader(c.r); c.err != nil {
+			log.Debugf("read PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+		}
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.remote = src; src == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
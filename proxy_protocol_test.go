@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	assert := assert.New(t)
+	src4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4321}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4321}
+
+	assert.Equal("PROXY TCP4 203.0.113.7 127.0.0.1 4321 22\r\n", string(proxyHeader(1, src4, dst4)))
+	assert.Equal("PROXY TCP6 2001:db8::1 :: 4321 0\r\n", string(proxyHeader(1, src6, dst4)))
+	assert.Equal("PROXY UNKNOWN\r\n", string(proxyHeader(1, nil, dst4)))
+
+	for _, version := range []int{1, 2} {
+		for _, src := range []*net.TCPAddr{src4, src6} {
+			header := proxyHeader(version, src, dst4)
+			r := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+			addr, err := readProxyHeader(r)
+			if assert.Nil(err) && assert.NotNil(addr) {
+				assert.Equal(src.String(), addr.String())
+			}
+			rest, _ := r.ReadString(0)
+			assert.Equal("data", rest)
+		}
+
+		r := bufio.NewReader(bytes.NewReader(proxyHeader(version, nil, nil)))
+		addr, err := readProxyHeader(r)
+		assert.Nil(err)
+		assert.Nil(addr)
+	}
+
+	for _, s := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7 127.0.0.1 4321\r\n",
+		"PROXY TCP4 2001:db8::1 127.0.0.1 4321 22\r\n",
+		"PROXY TCP4 203.0.113.7 127.0.0.1 4321 22\n",
+		"PROXY TCP4 " + string(make([]byte, 128)),
+	} {
+		_, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString(s)))
+		assert.Equal(ErrProxyHeader, err, s)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	assert := assert.New(t)
+	lsn := proxyListener{listenLocal(t)}
+	defer lsn.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", lsn.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4321 80\r\nhello"))
+		conn.Close()
+	}()
+	conn, err := lsn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal("203.0.113.7:4321", conn.RemoteAddr().String())
+	data, _ := bufio.NewReader(conn).ReadString(0)
+	assert.Equal("hello", data)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(l.Allow())
+	}
+	assert.False(l.Allow())
+
+	now = now.Add(time.Millisecond * 500)
+	assert.True(l.Allow())
+	assert.False(l.Allow())
+
+	// tokens never exceed burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(l.Allow())
+	}
+	assert.False(l.Allow())
+}
@@ -3,41 +3,481 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
+// Route maps hosts to route records. A key is a host, optionally followed by
+// a path prefix, such as "example.com/api". A host may start with "*." to
+// match all of its subdomains.
 type Route map[string]RouteRecord
 
 type RouteRecord struct {
-	AgentID string
-	Host    string
+	// AgentIDs are the agents serving the route, an id prefixed with '@' is
+	// the name of an agent group.
+	AgentIDs []string
+	Host     string
+	// Balance is the strategy to choose an agent, the default strategy of
+	// broker is used if it is empty.
+	Balance string
+
+	Timeouts        Timeouts
+	RequestHeaders  HeaderRewrite
+	ResponseHeaders HeaderRewrite
+	// Auth maps user names to bcrypt hashed passwords of HTTP basic auth, the
+	// route is public if it is empty.
+	Auth      Passwords
+	RateLimit *RateLimiter
+	// StripPrefix removes the path prefix of the route from requests.
+	StripPrefix bool
+	// MaxBodySize limits the size of request bodies in bytes, 0 means no
+	// limit.
+	MaxBodySize int64
+	// ErrorPage is the template of HTML error pages, the one of broker is
+	// used if it is nil.
+	ErrorPage *template.Template
+	// TrustForwarded keeps the forwarding headers sent by clients, such as
+	// X-Forwarded-For, it should be set only behind a trusted proxy.
+	TrustForwarded bool
+	// ProxyProtocol is the version of the PROXY protocol header sent to the
+	// upstream by the agent, 0 means no header.
+	ProxyProtocol int
+
+	// Key and Path are the route key and its path prefix, they are set by
+	// Route.Match.
+	Key  string
+	Path string
 }
 
-func ReadJsonRoute(filename string) (r Route, err error) {
-	f, err := os.Open(filename)
-	if err != nil {
+// Match returns the record of the best route for host and path. An exact
+// host is preferred to a wildcard one, and a longer wildcard is preferred to
+// a shorter one. Among the routes of a host, the longest path prefix wins.
+func (r Route) Match(host, path string) (record RouteRecord, ok bool) {
+	host = normalizeHost(host)
+	hostRank, pathLen := -1, -1
+	for key, rec := range r {
+		h, p := splitRouteKey(key)
+		rank := matchHost(h, host)
+		if rank < 0 || rank < hostRank || !matchPath(p, path) {
+			continue
+		}
+		if rank == hostRank && len(p) <= pathLen {
+			continue
+		}
+		hostRank, pathLen = rank, len(p)
+		record, ok = rec, true
+		record.Key, record.Path = key, p
+	}
+	return
+}
+
+// StripPath removes the path prefix of the route from u if StripPrefix is
+// set.
+func (r RouteRecord) StripPath(u *url.URL) {
+	if !r.StripPrefix || r.Path == "" {
 		return
 	}
-	defer f.Close()
+	u.Path = strings.TrimPrefix(u.Path, strings.TrimSuffix(r.Path, "/"))
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	u.RawPath = ""
+}
+
+// sameUpstream reports whether a transfer of o can serve the requests of r,
+// that is the records are of the same route and connect to the same
+// upstream through the same agents.
+func (r RouteRecord) sameUpstream(o RouteRecord) bool {
+	return r.Key == o.Key && r.Host == o.Host && r.ProxyProtocol == o.ProxyProtocol &&
+		strings.Join(r.AgentIDs, ",") == strings.Join(o.AgentIDs, ",")
+}
+
+// splitRouteKey splits a route key into the normalized host and the path
+// prefix.
+func splitRouteKey(key string) (host, path string) {
+	host = key
+	if i := strings.Index(key, "/"); i >= 0 {
+		host, path = key[:i], key[i:]
+	}
+	return normalizeHost(host), path
+}
+
+// normalizeHost lowercases host and removes its port and trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// matchHost returns the rank of pattern matching host, or -1 if it does not
+// match. An exact match has the highest rank.
+func matchHost(pattern, host string) int {
+	if pattern == host {
+		return math.MaxInt32
+	}
+	if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+		return len(pattern)
+	}
+	return -1
+}
+
+// matchPath reports whether prefix is a path prefix of path on a segment
+// boundary, so "/api" matches "/api" and "/api/v1" but not "/apix".
+func matchPath(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || prefix[len(prefix)-1] == '/' || path[len(prefix)] == '/'
+}
+
+// Check checks the basic auth and rate limit of req, the credentials of basic
+// auth are removed from req.
+func (r RouteRecord) Check(req *http.Request) error {
+	if len(r.Auth) > 0 {
+		user, password, ok := req.BasicAuth()
+		if !ok || !r.Auth.Verify(user, password) {
+			return HErrUnauthorized
+		}
+		req.Header.Del("Authorization")
+	}
+	if r.RateLimit != nil && !r.RateLimit.Allow() {
+		return HErrTooManyRequests
+	}
+	return nil
+}
 
-	rawRoute := map[string]string{}
-	err = json.NewDecoder(f).Decode(&rawRoute)
+// Timeouts of a transfer, 0 means no timeout.
+type Timeouts struct {
+	// Connect is the time for the agent to connect to the upstream.
+	Connect Duration `json:"connect" yaml:"connect"`
+	// FirstByte is the time from sending a request to receiving the first
+	// byte of its response.
+	FirstByte Duration `json:"firstByte" yaml:"firstByte"`
+	// Idle is the time a transfer can go without sending or receiving data.
+	Idle Duration `json:"idle" yaml:"idle"`
+}
+
+type HeaderRewrite struct {
+	Set    map[string]string `json:"set" yaml:"set"`
+	Remove []string          `json:"remove" yaml:"remove"`
+}
+
+func (r HeaderRewrite) Apply(h http.Header) {
+	for _, key := range r.Remove {
+		h.Del(key)
+	}
+	for key, value := range r.Set {
+		h.Set(key, value)
+	}
+}
+
+// Duration is a time.Duration written as a string like "1m30s" in route
+// files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// routeFile is the structured route file format.
+type routeFile struct {
+	Routes []routeConfig `json:"routes" yaml:"routes"`
+}
+
+type routeConfig struct {
+	Host     string   `json:"host" yaml:"host"`
+	Path     string   `json:"path" yaml:"path"`
+	Agent    string   `json:"agent" yaml:"agent"`
+	Agents   []string `json:"agents" yaml:"agents"`
+	Upstream string   `json:"upstream" yaml:"upstream"`
+	Balance  string   `json:"balance" yaml:"balance"`
+
+	Timeouts        Timeouts          `json:"timeouts" yaml:"timeouts"`
+	StripPrefix     bool              `json:"stripPrefix" yaml:"stripPrefix"`
+	MaxBodySize     int64             `json:"maxBodySize" yaml:"maxBodySize"`
+	ErrorPage       string            `json:"errorPage" yaml:"errorPage"`
+	TrustForwarded  bool              `json:"trustForwarded" yaml:"trustForwarded"`
+	ProxyProtocol   int               `json:"proxyProtocol" yaml:"proxyProtocol"`
+	RequestHeaders  HeaderRewrite     `json:"requestHeaders" yaml:"requestHeaders"`
+	ResponseHeaders HeaderRewrite     `json:"responseHeaders" yaml:"responseHeaders"`
+	Auth            map[string]string `json:"auth" yaml:"auth"`
+	RateLimit       *struct {
+		Rate  float64 `json:"rate" yaml:"rate"`
+		Burst int     `json:"burst" yaml:"burst"`
+	} `json:"rateLimit" yaml:"rateLimit"`
+}
+
+// ReadRoute reads a route file. Files with the extension .yaml or .yml are
+// parsed as YAML, others are parsed as JSON.
+//
+// The structured format is a list of routes:
+//
+//	{"routes": [{"host": "example.com", "agents": ["a1"], "upstream": "127.0.0.1:80"}]}
+//
+// A host of "*.example.com" matches all subdomains of example.com, and
+// requests are routed by the longest matching path. The path prefix is
+// removed from requests if stripPrefix is true.
+//
+// The flat format maps hosts to "agent-ids:upstream" strings, where
+// agent-ids is a comma separated list:
+//
+//	{"example.com": "a1,a2:127.0.0.1:80"}
+func ReadRoute(filename string) (r Route, err error) {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
 	}
+	unmarshal := json.Unmarshal
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	}
+
+	var flat map[string]string
+	if unmarshal(data, &flat) == nil {
+		return parseFlatRoute(flat)
+	}
+	var file routeFile
+	if err = unmarshal(data, &file); err != nil {
+		return
+	}
+	// error pages are relative to the route file
+	for i, c := range file.Routes {
+		if c.ErrorPage != "" && !filepath.IsAbs(c.ErrorPage) {
+			file.Routes[i].ErrorPage = filepath.Join(filepath.Dir(filename), c.ErrorPage)
+		}
+	}
+	return parseRouteFile(file)
+}
 
+func parseFlatRoute(flat map[string]string) (r Route, err error) {
 	r = make(Route)
-	for host, record := range rawRoute {
-		i := strings.Index(record, ":")
-		if i < 0 {
-			err = errors.New("invalid route format")
+	for host, record := range flat {
+		key := routeKey(splitRouteKey(host))
+		if _, ok := r[key]; ok {
+			err = fmt.Errorf("duplicate route of %s", host)
+			return
+		}
+		if r[key], err = parseFlatRecord(record); err != nil {
+			err = fmt.Errorf("route of %s: %s", host, err)
 			return
 		}
-		r[host] = RouteRecord{
-			AgentID: record[:i],
-			Host:    record[i+1:],
+	}
+	return
+}
+
+// parseFlatRecord parses a route record in the form of
+// "agent-ids:upstream".
+func parseFlatRecord(s string) (record RouteRecord, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		err = fmt.Errorf("invalid route format %q", s)
+		return
+	}
+	record = RouteRecord{
+		AgentIDs: strings.Split(s[:i], ","),
+		Host:     s[i+1:],
+	}
+	err = validAgentIDs(record.AgentIDs)
+	return
+}
+
+func parseRouteFile(file routeFile) (r Route, err error) {
+	r = make(Route)
+	for i, c := range file.Routes {
+		key := routeKey(normalizeHost(c.Host), c.Path)
+		if err = parseRouteConfig(r, key, c); err != nil {
+			return nil, fmt.Errorf("route #%d %s: %s", i+1, key, err)
 		}
 	}
 	return
 }
+
+func routeKey(host, path string) string {
+	if path == "/" {
+		path = ""
+	}
+	return host + path
+}
+
+func parseRouteConfig(r Route, key string, c routeConfig) (err error) {
+	if c.Host == "" {
+		return errors.New("host is empty")
+	}
+	if c.Path != "" && c.Path[0] != '/' {
+		return errors.New("path must start with /")
+	}
+	if _, ok := r[key]; ok {
+		return errors.New("duplicate route")
+	}
+	if c.Upstream == "" {
+		return errors.New("upstream is empty")
+	}
+
+	record := RouteRecord{
+		AgentIDs:        c.Agents,
+		Host:            c.Upstream,
+		Balance:         c.Balance,
+		Timeouts:        c.Timeouts,
+		StripPrefix:     c.StripPrefix,
+		MaxBodySize:     c.MaxBodySize,
+		TrustForwarded:  c.TrustForwarded,
+		ProxyProtocol:   c.ProxyProtocol,
+		RequestHeaders:  c.RequestHeaders,
+		ResponseHeaders: c.ResponseHeaders,
+	}
+	if c.Agent != "" {
+		record.AgentIDs = append([]string{c.Agent}, record.AgentIDs...)
+	}
+	if err = validAgentIDs(record.AgentIDs); err != nil {
+		return
+	}
+	if record.Balance != "" && !validBalance(record.Balance) {
+		return fmt.Errorf("unknown balance strategy %q", record.Balance)
+	}
+	if record.MaxBodySize < 0 {
+		return errors.New("maxBodySize is negative")
+	}
+	if record.ProxyProtocol < 0 || record.ProxyProtocol > 2 {
+		return fmt.Errorf("unknown PROXY protocol version %d", record.ProxyProtocol)
+	}
+	if c.ErrorPage != "" {
+		if record.ErrorPage, err = LoadErrorPage(c.ErrorPage); err != nil {
+			return fmt.Errorf("load error page: %s", err)
+		}
+	}
+
+	if len(c.Auth) > 0 {
+		record.Auth = make(Passwords)
+		for user, hash := range c.Auth {
+			if record.Auth[user], err = parsePasswordHash(hash); err != nil {
+				return fmt.Errorf("password of %s: %s", user, err)
+			}
+		}
+	}
+
+	if c.RateLimit != nil {
+		if c.RateLimit.Rate <= 0 {
+			return errors.New("rate of rate limit must be positive")
+		}
+		record.RateLimit = NewRateLimiter(c.RateLimit.Rate, c.RateLimit.Burst)
+	}
+
+	r[key] = record
+	return
+}
+
+func validAgentIDs(ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("no agent")
+	}
+	for _, id := range ids {
+		if id == "" || id == "@" {
+			return fmt.Errorf("invalid agent id %q", id)
+		}
+	}
+	return nil
+}
+
+// RouteWatcher reloads the route file when it is changed or SIGHUP is
+// received. A route file that can not be read is logged and ignored.
+type RouteWatcher struct {
+	Filename string
+	// Interval is the interval to check the modification of file, the file
+	// is only reloaded on SIGHUP if Interval is 0.
+	Interval time.Duration
+	OnChange func(Route)
+
+	modTime time.Time
+	size    int64
+}
+
+// Watch watches the route file until done is closed.
+func (w *RouteWatcher) Watch(done <-chan struct{}) {
+	w.changed()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if w.Interval > 0 {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+			log.Info("SIGHUP received, reload route file ", w.Filename)
+			w.changed()
+			w.Reload()
+		case <-tick:
+			if w.changed() {
+				log.Info("route file changed, reload ", w.Filename)
+				w.Reload()
+			}
+		}
+	}
+}
+
+// changed reports whether the file is modified since the last call.
+func (w *RouteWatcher) changed() bool {
+	fi, err := os.Stat(w.Filename)
+	if err != nil {
+		return false
+	}
+	if fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+	return true
+}
+
+func (w *RouteWatcher) Reload() {
+	route, err := ReadRoute(w.Filename)
+	if err != nil {
+		log.Errorf("reload route file %s: %s, keep using the current route", w.Filename, err)
+		return
+	}
+	w.OnChange(route)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReadRoute(t *testing.T) {
+	assert := assert.New(t)
+	filename := writeTempFile(t, `{
+		"a.example.com": "agent-a:127.0.0.1:8000",
+		"b.example.com": "agent-a,@group-b:localhost:9000"
+	}`)
+	defer os.Remove(filename)
+
+	route, err := ReadRoute(filename)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(Route{
+		"a.example.com": {AgentIDs: []string{"agent-a"}, Host: "127.0.0.1:8000"},
+		"b.example.com": {AgentIDs: []string{"agent-a", "@group-b"}, Host: "localhost:9000"},
+	}, route)
+}
+
+func TestReadInvalidFlatRoute(t *testing.T) {
+	for _, content := range []string{
+		`{"a.example.com": "127.0.0.1"}`,
+		`{"a.example.com": ":127.0.0.1:8000"}`,
+		`{"a.example.com": "agent-a,:127.0.0.1:8000"}`,
+		`{"a.example.com": "agent-a:"}`,
+		`{"a.example.com": `,
+	} {
+		filename := writeTempFile(t, content)
+		_, err := ReadRoute(filename)
+		assert.NotNil(t, err, content)
+		os.Remove(filename)
+	}
+}
+
+func TestReadStructuredRoute(t *testing.T) {
+	assert := assert.New(t)
+	json := writeTempFileExt(t, ".json", `{"routes": [
+		{"host": "a.example.com", "agent": "agent-a", "upstream": "127.0.0.1:8000"},
+		{
+			"host": "b.example.com",
+			"path": "/api",
+			"agents": ["agent-a", "@group-b"],
+			"upstream": "127.0.0.1:9000",
+			"balance": "least-active",
+			"timeouts": {"connect": "5s", "firstByte": "1m", "idle": "90s"},
+			"requestHeaders": {"set": {"X-Env": "test"}, "remove": ["Cookie"]},
+			"responseHeaders": {"remove": ["Server"]},
+			"auth": {"alice": "`+string(mustHashPassword("secret"))+`"},
+			"rateLimit": {"rate": 10, "burst": 20},
+			"maxBodySize": 1048576
+		}
+	]}`)
+	defer os.Remove(json)
+	yaml := writeTempFileExt(t, ".yaml", `
+routes:
+  - host: a.example.com
+    agent: agent-a
+    upstream: 127.0.0.1:8000
+  - host: b.example.com
+    path: /api
+    agents: [agent-a, "@group-b"]
+    upstream: 127.0.0.1:9000
+    balance: least-active
+    timeouts: {connect: 5s, firstByte: 1m, idle: 90s}
+    requestHeaders:
+      set: {X-Env: test}
+      remove: [Cookie]
+    responseHeaders:
+      remove: [Server]
+    auth:
+      alice: "`+string(mustHashPassword("secret"))+`"
+    rateLimit: {rate: 10, burst: 20}
+    maxBodySize: 1048576
+`)
+	defer os.Remove(yaml)
+
+	for _, filename := range []string{json, yaml} {
+		route, err := ReadRoute(filename)
+		if !assert.Nil(err, filename) {
+			continue
+		}
+		assert.Len(route, 2)
+		assert.Equal([]string{"agent-a"}, route["a.example.com"].AgentIDs)
+		assert.Equal("127.0.0.1:8000", route["a.example.com"].Host)
+
+		r := route["b.example.com/api"]
+		assert.Equal([]string{"agent-a", "@group-b"}, r.AgentIDs)
+		assert.Equal("127.0.0.1:9000", r.Host)
+		assert.Equal(BalanceLeastActive, r.Balance)
+		assert.Equal(Timeouts{
+			Connect:   Duration(time.Second * 5),
+			FirstByte: Duration(time.Minute),
+			Idle:      Duration(time.Second * 90),
+		}, r.Timeouts)
+		assert.Equal(HeaderRewrite{
+			Set:    map[string]string{"X-Env": "test"},
+			Remove: []string{"Cookie"},
+		}, r.RequestHeaders)
+		assert.Equal([]string{"Server"}, r.ResponseHeaders.Remove)
+		assert.True(r.Auth.Verify("alice", "secret"))
+		assert.NotNil(r.RateLimit)
+		assert.Equal(int64(1048576), r.MaxBodySize)
+	}
+}
+
+func TestReadInvalidStructuredRoute(t *testing.T) {
+	for _, content := range []string{
+		`{"routes": [{"agent": "a", "upstream": "127.0.0.1:80"}]}`,
+		`{"routes": [{"host": "a.com", "upstream": "127.0.0.1:80"}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a"}]}`,
+		`{"routes": [{"host": "a.com", "path": "api", "agent": "a", "upstream": "127.0.0.1:80"}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "balance": "random"}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "auth": {"u": "plain"}}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "auth": {"u": "` + HashToken("p") + `"}}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "rateLimit": {"rate": 0}}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "timeouts": {"idle": "1 day"}}]}`,
+		`{"routes": [{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "maxBodySize": -1}]}`,
+		`{"routes": [
+			{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80"},
+			{"host": "a.com", "agent": "b", "upstream": "127.0.0.1:80"}
+		]}`,
+	} {
+		filename := writeTempFile(t, content)
+		_, err := ReadRoute(filename)
+		assert.NotNil(t, err, content)
+		os.Remove(filename)
+	}
+}
+
+func TestRouteCheck(t *testing.T) {
+	assert := assert.New(t)
+	r := RouteRecord{
+		Auth:      Passwords{"alice": mustHashPassword("secret")},
+		RateLimit: NewRateLimiter(1, 1),
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	assert.Equal(HErrUnauthorized, r.Check(req))
+	req.SetBasicAuth("alice", "wrong")
+	assert.Equal(HErrUnauthorized, r.Check(req))
+
+	req.SetBasicAuth("alice", "secret")
+	assert.Nil(r.Check(req))
+	assert.Empty(req.Header.Get("Authorization"))
+
+	req.SetBasicAuth("alice", "secret")
+	assert.Equal(HErrTooManyRequests, r.Check(req))
+}
+
+// mustHashPassword hashes password with the minimum cost to keep tests fast.
+func mustHashPassword(password string) []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+func mustParseTokenHash(hash string) []byte {
+	digest, err := parseTokenHash(hash)
+	if err != nil {
+		panic(err)
+	}
+	return digest
+}
+
+func TestRouteMatch(t *testing.T) {
+	route := Route{
+		"example.com":           {Host: "root"},
+		"example.com/api":       {Host: "api"},
+		"example.com/api/v2":    {Host: "api-v2"},
+		"*.example.com":         {Host: "wildcard"},
+		"*.a.example.com":       {Host: "wildcard-a"},
+		"b.example.com":         {Host: "b"},
+		"b.example.com/static/": {Host: "b-static"},
+	}
+	for _, c := range []struct {
+		host, path string
+		want       string
+	}{
+		{"example.com", "/", "root"},
+		{"EXAMPLE.com:8080", "/", "root"},
+		{"example.com.", "/", "root"},
+		{"example.com", "/api", "api"},
+		{"example.com", "/api/users", "api"},
+		{"example.com", "/apix", "root"},
+		{"example.com", "/api/v2/users", "api-v2"},
+		{"x.example.com", "/", "wildcard"},
+		{"y.x.example.com", "/api", "wildcard"},
+		{"x.a.example.com", "/", "wildcard-a"},
+		{"b.example.com", "/", "b"},
+		{"b.example.com", "/static/app.js", "b-static"},
+		{"b.example.com", "/static", "b"},
+		{"other.com", "/", ""},
+		{"badexample.com", "/", ""},
+	} {
+		record, ok := route.Match(c.host, c.path)
+		assert.Equal(t, c.want != "", ok, c.host+c.path)
+		assert.Equal(t, c.want, record.Host, c.host+c.path)
+	}
+}
+
+func TestRouteStripPath(t *testing.T) {
+	route := Route{"example.com/api": {StripPrefix: true}}
+	record, _ := route.Match("example.com", "/api/users")
+	assert.Equal(t, "/api", record.Path)
+	for path, want := range map[string]string{
+		"/api/users": "/users",
+		"/api":       "/",
+		"/api/":      "/",
+	} {
+		u, _ := url.Parse("http://example.com" + path)
+		record.StripPath(u)
+		assert.Equal(t, want, u.Path, path)
+	}
+}
+
+func TestReadRouteNormalizeKeys(t *testing.T) {
+	filename := writeTempFile(t, `{"routes": [
+		{"host": "Example.COM", "path": "/", "agent": "a", "upstream": "127.0.0.1:80"},
+		{"host": "*.Example.com", "path": "/api", "agent": "a", "upstream": "127.0.0.1:80"}
+	]}`)
+	defer os.Remove(filename)
+	route, err := ReadRoute(filename)
+	if assert.Nil(t, err) {
+		assert.Contains(t, route, "example.com")
+		assert.Contains(t, route, "*.example.com/api")
+	}
+
+	filename2 := writeTempFile(t, `{"example.com": "a:127.0.0.1:80", "EXAMPLE.com": "b:127.0.0.1:80"}`)
+	defer os.Remove(filename2)
+	_, err = ReadRoute(filename2)
+	assert.NotNil(t, err)
+}
+
+func TestReadRouteErrorPage(t *testing.T) {
+	page := writeTempFileExt(t, ".html", "<p>{{.Status}}</p>")
+	defer os.Remove(page)
+	// the error page is relative to the route file
+	filename := writeTempFile(t, `{"routes": [
+		{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "errorPage": "`+filepath.Base(page)+`"}
+	]}`)
+	defer os.Remove(filename)
+	route, err := ReadRoute(filename)
+	if assert.Nil(t, err) && assert.NotNil(t, route["a.com"].ErrorPage) {
+		_, body := writeHTTPError(t, HErrBadGateway, ErrorContext{Page: route["a.com"].ErrorPage})
+		assert.Equal(t, "<p>502</p>", body)
+	}
+
+	filename2 := writeTempFile(t, `{"routes": [
+		{"host": "a.com", "agent": "a", "upstream": "127.0.0.1:80", "errorPage": "no-such-page.html"}
+	]}`)
+	defer os.Remove(filename2)
+	_, err = ReadRoute(filename2)
+	assert.NotNil(t, err)
+}
+
+func TestRouteWatcher(t *testing.T) {
+	assert := assert.New(t)
+	filename := writeTempFile(t, `{"a.example.com": "agent-a:127.0.0.1:8000"}`)
+	defer os.Remove(filename)
+
+	changes := make(chan Route, 1)
+	w := RouteWatcher{
+		Filename: filename,
+		Interval: time.Millisecond * 10,
+		OnChange: func(route Route) { changes <- route },
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go w.Watch(done)
+	time.Sleep(time.Millisecond * 50)
+
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filename, mtime, mtime)
+	}
+
+	// an invalid file is ignored
+	write(`{"a.example.com": "agent-a"}`, time.Now().Add(time.Second))
+	select {
+	case <-changes:
+		t.Fatal("invalid route file is loaded")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	write(`{"a.example.com": "agent-b:127.0.0.1:8000"}`, time.Now().Add(time.Second*2))
+	select {
+	case route := <-changes:
+		assert.Equal([]string{"agent-b"}, route["a.example.com"].AgentIDs)
+	case <-time.After(time.Second):
+		t.Fatal("route file is not reloaded")
+	}
+}
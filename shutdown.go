@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connSet tracks the http connections, so the idle ones can be closed when
+// the broker is shutting down or their agents are going away.
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]connState
+	closed bool
+}
+
+type connState struct {
+	idle bool
+	// agent serves the last request of the connection
+	agent *Agent
+}
+
+// add adds conn to the set, it returns false if the set is closed.
+func (s *connSet) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = connState{}
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// setIdle marks whether conn is waiting for a new request after a request
+// served by agent, it returns false if the set is closed or agent is going
+// away.
+func (s *connSet) setIdle(conn net.Conn, idle bool, agent *Agent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = connState{idle: idle, agent: agent}
+	return !s.closed && !agent.isGoingAway()
+}
+
+// closeIdle closes the idle connections whose last requests are served by
+// agent.
+func (s *connSet) closeIdle(agent *Agent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, st := range s.conns {
+		if st.idle && st.agent == agent {
+			conn.Close()
+		}
+	}
+}
+
+// close closes the idle connections, busy connections are closed by their
+// handlers after the current request.
+func (s *connSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn, st := range s.conns {
+		if st.idle {
+			conn.Close()
+		}
+	}
+}
+
+type shutdownStats struct {
+	start time.Time
+	// inflight is the number of transfers when the shutdown starts.
+	inflight int
+}
+
+// inflight returns the number of unfinished transfers.
+func (b *Broker) inflight() (n int) {
+	for _, agents := range b.agents {
+		for _, agent := range agents {
+			n += len(agent.tfs)
+		}
+	}
+	return
+}
+
+// startShutdown stops accepting http requests and tells agents the broker is
+// going away, in-flight transfers may finish before the returned channel
+// fires.
+func (b *Broker) startShutdown() <-chan time.Time {
+	b.shutdown = &shutdownStats{start: time.Now(), inflight: b.inflight()}
+	log.Infof("shutting down, waiting up to %s for %d in-flight transfers", b.ShutdownGrace, b.shutdown.inflight)
+
+	b.httpConns.close()
+	for _, agents := range b.agents {
+		for _, agent := range agents {
+			agent.SendMessage(GoAwayMessage{Reason: "broker is shutting down"})
+		}
+	}
+	return time.After(b.ShutdownGrace)
+}
+
+// stop disconnects all agents and aborts the remaining transfers.
+func (b *Broker) stop() {
+	aborted, agents := b.inflight(), 0
+	var wg sync.WaitGroup
+	for _, as := range b.agents {
+		for _, agent := range as {
+			agents++
+			for _, tf := range agent.tfs {
+				tf.SetError(HErrShuttingDown)
+			}
+			wg.Add(1)
+			go func(agent *Agent) {
+				defer wg.Done()
+				agent.flushAndClose()
+			}(agent)
+		}
+	}
+	wg.Wait()
+	log.Infof("broker stopped in %s: %d transfers served, %d finished during shutdown, %d aborted, %d agents disconnected",
+		time.Since(b.shutdown.start).Round(time.Millisecond), b.transfers,
+		b.shutdown.inflight-aborted, aborted, agents)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// InitialWindowSize is the number of bytes a peer may send on a new stream
+// before it receives any WindowUpdateMessage.
+const InitialWindowSize = 256 * 1024
+
+var (
+	ErrWriterClosed   = errors.New("message writer has been closed")
+	ErrWindowExceeded = errors.New("peer sent more data than the window allows")
+)
+
+// Window is the send window of a stream. A sender must take credit from the
+// window before sending data, and credit is given back by the receiver with
+// WindowUpdateMessage after the data is consumed.
+type Window struct {
+	cond *sync.Cond
+	size int
+	err  error
+}
+
+func NewWindow(size int) *Window {
+	return &Window{
+		cond: sync.NewCond(new(sync.Mutex)),
+		size: size,
+	}
+}
+
+// Take blocks until the window is not empty, then takes at most max bytes of
+// credit from it.
+func (w *Window) Take(max int) (n int, err error) {
+	w.cond.L.Lock()
+	for w.err == nil && w.size == 0 {
+		w.cond.Wait()
+	}
+	if err = w.err; err == nil {
+		if n = max; n > w.size {
+			n = w.size
+		}
+		w.size -= n
+	}
+	w.cond.L.Unlock()
+	return
+}
+
+func (w *Window) Add(n int) {
+	w.cond.L.Lock()
+	w.size += n
+	w.cond.L.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *Window) SetError(err error) {
+	w.cond.L.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.cond.L.Unlock()
+	w.cond.Broadcast()
+}
+
+// StreamBuffer is the receiving buffer of a stream. Write never blocks since
+// the peer can not send more than its window, and onConsume is called with
+// the number of consumed bytes so the peer's window can be updated. The
+// buffered data never exceeds InitialWindowSize, a peer ignoring its window
+// gets ErrWindowExceeded.
+type StreamBuffer struct {
+	data      bytes.Buffer
+	cond      *sync.Cond
+	err       error
+	consumed  int
+	onConsume func(n int)
+}
+
+func NewStreamBuffer(onConsume func(n int)) *StreamBuffer {
+	return &StreamBuffer{
+		cond:      sync.NewCond(new(sync.Mutex)),
+		onConsume: onConsume,
+	}
+}
+
+func (b *StreamBuffer) Write(p []byte) (n int, err error) {
+	b.cond.L.Lock()
+	if err = b.err; err == nil {
+		if b.data.Len()+len(p) > InitialWindowSize {
+			b.err, err = ErrWindowExceeded, ErrWindowExceeded
+		} else {
+			n, err = b.data.Write(p)
+		}
+	}
+	b.cond.L.Unlock()
+	b.cond.Signal()
+	return
+}
+
+func (b *StreamBuffer) Read(p []byte) (n int, err error) {
+	var update int
+	b.cond.L.Lock()
+	for b.err == nil && b.data.Len() == 0 {
+		b.cond.Wait()
+	}
+	if b.data.Len() > 0 {
+		n, err = b.data.Read(p)
+		// update the window when half of it is consumed
+		if b.consumed += n; b.consumed >= InitialWindowSize/2 {
+			update, b.consumed = b.consumed, 0
+		}
+	} else {
+		err = b.err
+	}
+	b.cond.L.Unlock()
+
+	if update > 0 && b.onConsume != nil {
+		b.onConsume(update)
+	}
+	return
+}
+
+func (b *StreamBuffer) Close() error {
+	return b.SetError(io.EOF)
+}
+
+// Err returns the error set by Close or SetError, buffered data may still be
+// readable.
+func (b *StreamBuffer) Err() error {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.err
+}
+
+// SetError makes Read return err after the buffered data is consumed.
+func (b *StreamBuffer) SetError(e error) (err error) {
+	b.cond.L.Lock()
+	if err = b.err; err == nil {
+		b.err = e
+	}
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+	return
+}
+
+// MessageWriter writes messages to a connection shared by many streams.
+// Control messages are written first, and data messages of different
+// streams are written in round-robin order, so a stream with a lot of data
+// can not starve the others.
+type MessageWriter struct {
+	wr     io.Writer
+	cond   *sync.Cond
+	ctrl   [][]byte
+	queues map[string][][]byte
+	ready  []string
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+func NewMessageWriter(wr io.Writer) *MessageWriter {
+	w := &MessageWriter{
+		wr:     wr,
+		cond:   sync.NewCond(new(sync.Mutex)),
+		queues: make(map[string][][]byte),
+		done:   make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// streamOf returns the TID of a data message. Other messages, including
+// WindowUpdateMessage, belong to no stream.
+func streamOf(msg Transferable) (tid string, ok bool) {
+	switch m := msg.(type) {
+	case DataMessage:
+		return m.TID, true
+	case FirstDataMessage:
+		return m.TID, true
+	case LastDataMessage:
+		return m.TID, true
+	}
+	return "", false
+}
+
+// Write queues msg to be written. It never blocks, the error returned is the
+// error of a previous write, if any.
+func (w *MessageWriter) Write(msg Transferable) error {
+	return w.write(msg, 0)
+}
+
+// WritePacket is like Write, but the datagram in msg is dropped if
+// packetQueueSize messages of its stream are queued. Datagrams are not
+// limited by the window, so they are dropped like udp does when the
+// connection is slower than the sender.
+func (w *MessageWriter) WritePacket(msg DataMessage) error {
+	return w.write(msg, packetQueueSize)
+}
+
+// write queues msg, a data message is dropped if limit is not 0 and the
+// queue of its stream is full.
+func (w *MessageWriter) write(msg Transferable, limit int) (err error) {
+	p := msg.Bytes()
+	w.cond.L.Lock()
+	if err = w.err; err == nil && w.closed {
+		err = ErrWriterClosed
+	}
+	if err == nil {
+		if tid, ok := streamOf(msg); !ok {
+			w.ctrl = append(w.ctrl, p)
+		} else if q := w.queues[tid]; limit == 0 || len(q) < limit {
+			if len(q) == 0 {
+				w.ready = append(w.ready, tid)
+			}
+			w.queues[tid] = append(q, p)
+		}
+	}
+	w.cond.L.Unlock()
+	w.cond.Signal()
+	return
+}
+
+func (w *MessageWriter) next() (p []byte) {
+	if len(w.ctrl) > 0 {
+		p, w.ctrl = w.ctrl[0], w.ctrl[1:]
+		return
+	}
+	tid := w.ready[0]
+	q := w.queues[tid]
+	p = q[0]
+	if len(q) == 1 {
+		delete(w.queues, tid)
+		w.ready = w.ready[1:]
+	} else {
+		w.queues[tid] = q[1:]
+		w.ready = append(w.ready[1:], tid)
+	}
+	return
+}
+
+func (w *MessageWriter) loop() {
+	defer close(w.done)
+	for {
+		w.cond.L.Lock()
+		for w.err == nil && !w.closed && len(w.ctrl) == 0 && len(w.ready) == 0 {
+			w.cond.Wait()
+		}
+		if w.err != nil || len(w.ctrl) == 0 && len(w.ready) == 0 {
+			if w.err == nil {
+				w.err = ErrWriterClosed
+			}
+			w.cond.L.Unlock()
+			return
+		}
+		p := w.next()
+		w.cond.L.Unlock()
+
+		if _, err := w.wr.Write(p); err != nil {
+			w.cond.L.Lock()
+			w.err = err
+			w.cond.L.Unlock()
+			return
+		}
+	}
+}
+
+// Close stops accepting messages and waits until the queued messages are
+// written or a write fails.
+func (w *MessageWriter) Close() error {
+	w.cond.L.Lock()
+	w.closed = true
+	w.cond.L.Unlock()
+	w.cond.Signal()
+	<-w.done
+	return nil
+}
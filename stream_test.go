@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedWriter blocks all writes until gate is closed.
+type gatedWriter struct {
+	gate    chan struct{}
+	written chan []byte
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	w.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWindow(t *testing.T) {
+	assert := assert.New(t)
+	w := NewWindow(10)
+
+	n, err := w.Take(4)
+	assert.Nil(err)
+	assert.Equal(4, n)
+	n, err = w.Take(100)
+	assert.Nil(err)
+	assert.Equal(6, n)
+
+	taken := make(chan int)
+	go func() {
+		n, _ := w.Take(100)
+		taken <- n
+	}()
+	select {
+	case <-taken:
+		t.Fatal("take from an empty window")
+	case <-time.After(time.Millisecond * 50):
+	}
+	w.Add(3)
+	assert.Equal(3, <-taken)
+
+	w.SetError(ErrWriterClosed)
+	_, err = w.Take(1)
+	assert.Equal(ErrWriterClosed, err)
+}
+
+func TestStreamBufferConsume(t *testing.T) {
+	assert := assert.New(t)
+	var consumed int
+	b := NewStreamBuffer(func(n int) { consumed += n })
+
+	b.Write(make([]byte, InitialWindowSize))
+	buf := make([]byte, InitialWindowSize/4)
+	b.Read(buf)
+	assert.Equal(0, consumed)
+	b.Read(buf)
+	assert.Equal(InitialWindowSize/2, consumed)
+
+	b.Close()
+	b.Read(buf)
+	b.Read(buf)
+	_, err := b.Read(buf)
+	assert.NotNil(err)
+}
+
+func TestMessageWriterRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+	wr := &gatedWriter{
+		gate:    make(chan struct{}),
+		written: make(chan []byte, 100),
+	}
+	w := NewMessageWriter(wr)
+
+	data := func(tid string) DataMessage {
+		return DataMessage{TID: tid, Data: []byte(tid)}
+	}
+	w.Write(data("a"))
+	// wait until the first message is being written
+	time.Sleep(time.Millisecond * 50)
+	for i := 0; i < 3; i++ {
+		w.Write(data("a"))
+	}
+	w.Write(data("b"))
+	w.Write(data("b"))
+	w.Write(TextMessage{Content: "ctrl"})
+	close(wr.gate)
+	w.Close()
+	close(wr.written)
+
+	var order []string
+	for p := range wr.written {
+		msg, err := NewMessageReader(bytes.NewReader(p)).Read()
+		assert.Nil(err)
+		switch m := msg.(type) {
+		case DataMessage:
+			order = append(order, m.TID)
+		case TextMessage:
+			order = append(order, m.Content)
+		}
+	}
+	assert.Equal([]string{"a", "ctrl", "a", "b", "a", "b", "a"}, order)
+	assert.Equal(ErrWriterClosed, w.Write(data("a")))
+}
+
+func TestStreamBufferExceedWindow(t *testing.T) {
+	assert := assert.New(t)
+	b := NewStreamBuffer(nil)
+	_, err := b.Write(make([]byte, InitialWindowSize))
+	assert.Nil(err)
+	_, err = b.Write([]byte{0})
+	assert.Equal(ErrWindowExceeded, err)
+
+	// the buffered data can still be read
+	n, err := io.ReadFull(b, make([]byte, InitialWindowSize))
+	assert.Equal(InitialWindowSize, n)
+	assert.Nil(err)
+	_, err = b.Read(make([]byte, 1))
+	assert.Equal(ErrWindowExceeded, err)
+}
+
+func TestMessageWriterDropPackets(t *testing.T) {
+	assert := assert.New(t)
+	wr := &gatedWriter{
+		gate:    make(chan struct{}),
+		written: make(chan []byte, packetQueueSize*2),
+	}
+	w := NewMessageWriter(wr)
+
+	// the first packet is being written, the rest are queued until the
+	// queue is full
+	for i := 0; i < packetQueueSize*2; i++ {
+		assert.Nil(w.WritePacket(DataMessage{TID: "a", Data: []byte{byte(i)}}))
+		if i == 0 {
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+	// other messages are never dropped
+	w.Write(LastDataMessage{DataMessage: DataMessage{TID: "a"}})
+	close(wr.gate)
+	w.Close()
+	close(wr.written)
+
+	var packets int
+	var last bool
+	for p := range wr.written {
+		msg, _ := NewMessageReader(bytes.NewReader(p)).Read()
+		switch msg.(type) {
+		case DataMessage:
+			packets++
+		case LastDataMessage:
+			last = true
+		}
+	}
+	assert.Equal(packetQueueSize+1, packets)
+	assert.True(last)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// ParseTunnel parses a tcp or udp tunnel in the form of
+// "listen-address=agent-ids:upstream", such as ":2222=agent-a:127.0.0.1:22".
+func ParseTunnel(network, s string) (addr string, route RouteRecord, err error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		err = fmt.Errorf("invalid %s tunnel %q, want listen-address=agent-ids:upstream", network, s)
+		return
+	}
+	addr = s[:i]
+	if route, err = parseFlatRecord(s[i+1:]); err != nil {
+		err = fmt.Errorf("%s tunnel %s: %s", network, addr, err)
+		return
+	}
+	route.Key = network + " " + addr
+	return
+}
+
+func (b *Broker) acceptTCP(lsn net.Listener, route RouteRecord) {
+	for {
+		conn, err := lsn.Accept()
+		if err != nil {
+			break
+		}
+		go b.handleTCPConn(conn, route)
+	}
+}
+
+// handleTCPConn pipes raw bytes between conn and an agent of route.
+func (b *Broker) handleTCPConn(conn net.Conn, route RouteRecord) {
+	defer conn.Close()
+	tf, err := b.CreateTunnel(route, conn.RemoteAddr().String())
+	if err != nil {
+		log.Debugf("tcp tunnel %s from %s: %s", route.Key, conn.RemoteAddr(), err)
+		return
+	}
+	defer tf.Close()
+	pipe(conn, tf)
+}
+
+// pipe copies data between conn and tf until both directions are finished.
+// When one direction reaches EOF, the write side of the other end is closed
+// so half-closed connections work as expected.
+func pipe(conn net.Conn, tf *Transferer) {
+	pipeFrom(conn, conn, tf, tf)
+}
+
+// pipeFrom is like pipe, but the data of conn and tf is read from cr and tr,
+// which may hold the data buffered before.
+func pipeFrom(conn net.Conn, cr io.Reader, tf *Transferer, tr io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(conn, tr); err != nil {
+			conn.Close()
+			return
+		}
+		closeWrite(conn)
+	}()
+
+	if _, err := io.Copy(tf, cr); err != nil {
+		tf.Close()
+	} else {
+		tf.CloseWrite()
+	}
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, conn is closed if it does
+// not support half-close.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTunnel(t *testing.T) {
+	assert := assert.New(t)
+	addr, route, err := ParseTunnel("tcp", ":2222=agent-a,@group-b:127.0.0.1:22")
+	if assert.Nil(err) {
+		assert.Equal(":2222", addr)
+		assert.Equal([]string{"agent-a", "@group-b"}, route.AgentIDs)
+		assert.Equal("127.0.0.1:22", route.Host)
+		assert.Equal("tcp :2222", route.Key)
+	}
+
+	for _, s := range []string{"", ":2222", "=agent-a:127.0.0.1:22", ":2222=127.0.0.1", ":2222=agent-a:"} {
+		_, _, err := ParseTunnel("tcp", s)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestTCPTunnel(t *testing.T) {
+	assert := assert.New(t)
+	// the server reads until EOF before it replies, so the tunnel must
+	// support half-close
+	server := listenLocal(t)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				data, _ := ioutil.ReadAll(conn)
+				fmt.Fprintf(conn, "received %d bytes", len(data))
+				conn.Close()
+			}()
+		}
+	}()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: server.Addr().String()}}
+	tunnel := listenLocal(t)
+	b.tunnels = map[net.Listener]RouteRecord{
+		tunnel: {AgentIDs: []string{"test-agent"}, Host: server.Addr().String(), Key: "tcp test"},
+	}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(make([]byte, 1024*1024))
+		conn.(*net.TCPConn).CloseWrite()
+		resp, err := ioutil.ReadAll(conn)
+		assert.Nil(err)
+		assert.Equal("received 1048576 bytes", string(resp))
+		conn.Close()
+	}
+}
+
+func TestTCPTunnelProxyProtocol(t *testing.T) {
+	assert := assert.New(t)
+	// the server replies with the client address in the PROXY protocol
+	// header sent by the agent
+	server := listenLocal(t)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, err := readProxyHeader(bufio.NewReader(conn))
+				if err != nil {
+					fmt.Fprint(conn, err)
+					return
+				}
+				fmt.Fprint(conn, addr)
+			}()
+		}
+	}()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: server.Addr().String()}}
+	b.tunnels = make(map[net.Listener]RouteRecord)
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	for _, version := range []int{1, 2} {
+		// the broker is behind a load balancer which sends PROXY protocol
+		// too
+		route := RouteRecord{AgentIDs: []string{"test-agent"}, Host: server.Addr().String(), ProxyProtocol: version}
+		lsn := proxyListener{listenLocal(t)}
+		go b.acceptTCP(lsn, route)
+
+		conn, err := net.Dial("tcp", lsn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 4321 2222\r\n")
+		resp, err := ioutil.ReadAll(conn)
+		assert.Nil(err)
+		assert.Equal("203.0.113.7:4321", string(resp), "version %d", version)
+		conn.Close()
+		lsn.Close()
+	}
+}
+
+func TestTCPTunnelUpstreamCloseDuringUpload(t *testing.T) {
+	// the server replies before the upload is finished, then closes
+	server := listenLocal(t)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 1024))
+				conn.Write([]byte("bye"))
+				conn.Close()
+			}()
+		}
+	}()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: server.Addr().String()}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	tunnel := listenLocal(t)
+	defer tunnel.Close()
+	route := RouteRecord{AgentIDs: []string{"test-agent"}, Host: server.Addr().String(), Key: "tcp test"}
+	handled := make(chan struct{})
+	go func() {
+		conn, err := tunnel.Accept()
+		if err != nil {
+			return
+		}
+		b.handleTCPConn(conn, route)
+		close(handled)
+	}()
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upload is never finished by the client
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second * 2):
+		t.Fatal("tcp tunnel is not closed after the upstream is closed")
+	}
+}
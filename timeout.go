@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrConnectTimeout is sent by agents when the upstream can not be
+	// connected in time.
+	ErrConnectTimeout   = errors.New("connect timeout")
+	ErrFirstByteTimeout = errors.New("first byte timeout")
+	ErrIdleTimeout      = errors.New("idle timeout")
+)
+
+// isTimeout reports whether err is caused by Timeouts.
+func isTimeout(err error) bool {
+	return err == ErrConnectTimeout || err == ErrFirstByteTimeout || err == ErrIdleTimeout
+}
+
+// watchIdle aborts the transfer with ErrIdleTimeout if no data is sent or
+// received for d, it stops watching once the response is finished.
+func (t *Transferer) watchIdle(d time.Duration) {
+	t.touch()
+	var check func()
+	check = func() {
+		if t.Response.Err() != nil {
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActive)))
+		if idle >= d {
+			t.abort(ErrIdleTimeout)
+			return
+		}
+		time.AfterFunc(d-idle, check)
+	}
+	time.AfterFunc(d, check)
+}
+
+// watchFirstByte aborts the transfer with ErrFirstByteTimeout if no
+// response data is received in d, the returned function stops watching.
+func (t *Transferer) watchFirstByte(d time.Duration) (stop func() bool) {
+	received := atomic.LoadInt64(&t.received)
+	timer := time.AfterFunc(d, func() {
+		if atomic.LoadInt64(&t.received) == received {
+			t.abort(ErrFirstByteTimeout)
+		}
+	})
+	return timer.Stop
+}
+
+// touch records that data is sent or received.
+func (t *Transferer) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
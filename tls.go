@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// LoadServerTLSConfig loads the certificate of broker. Agents must present a
+// certificate signed by clientCA if clientCA is not empty.
+func LoadServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %s", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCA != "" {
+		if conf.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// LoadClientTLSConfig creates the TLS config used by agent. The broker is
+// verified with the system roots if ca is empty, and is not verified at all
+// if insecure is true. certFile and keyFile are optional.
+func LoadClientTLSConfig(ca string, insecure bool, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: insecure}
+
+	if ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("load CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// peerCommonName returns the common name of the verified client certificate
+// of conn, ok is false if conn is not a TLS connection or the client did not
+// present a certificate.
+func peerCommonName(conn net.Conn) (cn string, ok bool, err error) {
+	tc, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	if cn = state.VerifiedChains[0][0].Subject.CommonName; cn == "" {
+		err = errors.New("common name of client certificate is empty")
+		return
+	}
+	ok = true
+	return
+}
+
+// CertStore selects a certificate by the server name sent by client. Each
+// PEM file in the directory should contain a certificate chain and its
+// private key, the certificate is used for all DNS names it contains.
+type CertStore struct {
+	certs map[string]*tls.Certificate
+}
+
+func LoadCertDir(dir string) (s *CertStore, err error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return
+	}
+
+	s = &CertStore{certs: make(map[string]*tls.Certificate)}
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(pem, pem)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %s", file, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %s", file, err)
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			s.certs[strings.ToLower(name)] = &cert
+			log.Debugf("certificate for %s loaded from %s", name, file)
+		}
+	}
+	if len(s.certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", dir)
+	}
+	return
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate. A certificate of
+// the exact server name is preferred to a wildcard certificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := s.certs[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.certs["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hrt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue creates a certificate for cn which is valid for both server and
+// client authentication.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAgentTLS(t *testing.T) {
+	ca := newTestCA(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: echo.Addr().String()}}
+	b.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "broker")}}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	agent := NewAgent("test-agent")
+	agent.TLSConfig = &tls.Config{RootCAs: ca.pool}
+	go agent.Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+}
+
+func TestAgentIDFromClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"cert-agent"}, Host: echo.Addr().String()}}
+	b.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "broker")},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+
+	// neither id nor token is needed
+	agent := NewAgent("")
+	agent.TLSConfig = &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "cert-agent")},
+	}
+	go agent.Connect(addr, "")
+	waitRoute(t, b, "test.host")
+}
+
+// writePEM writes cert and its private key to a PEM file.
+func writePEM(t *testing.T, filename string, cert tls.Certificate) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})...)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA(t)
+	dir, err := ioutil.TempDir("", "hrt-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writePEM(t, filepath.Join(dir, "foo.pem"), ca.issue(t, "foo", "foo.example.com"))
+	writePEM(t, filepath.Join(dir, "wildcard.pem"), ca.issue(t, "wildcard", "*.example.com"))
+
+	s, err := LoadCertDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"foo.example.com": "foo",
+		"FOO.example.com": "foo",
+		"bar.example.com": "wildcard",
+		"example.com":     "",
+		"a.b.example.com": "",
+	}
+	for name, cn := range cases {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if cn == "" {
+			assert.NotNil(err, name)
+			continue
+		}
+		if assert.Nil(err, name) {
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+			assert.Equal(cn, leaf.Subject.CommonName, name)
+		}
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	ca := newTestCA(t)
+	dir, err := ioutil.TempDir("", "hrt-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writePEM(t, filepath.Join(dir, "test.pem"), ca.issue(t, "test", "test.host"))
+	certs, err := LoadCertDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+
+	b := &Broker{Token: "test-token"}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: backend.Listener.Addr().String()}}
+	httpsLsn := tls.NewListener(listenLocal(t), certs.TLSConfig())
+	addr, stop := serveTestBroker(t, b, httpsLsn)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: ca.pool},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return net.Dial(network, httpsLsn.Addr().String())
+		},
+	}}
+	resp, err := client.Get("https://test.host/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "https", string(body))
+}
@@ -1,12 +1,122 @@
 package main
 
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Transferer is the broker side end of a tunnel. Data written to it is sent
+// to the agent, and data sent back by the agent can be read from it.
 type Transferer struct {
-	Request, Response *BlockedBuffer
+	// lastActive is the time data is last sent or received in unix
+	// nanoseconds, and received is the number of response bytes, they are
+	// used by the watchdogs of Timeouts. They are accessed atomically, so
+	// they are kept 64-bit aligned at the beginning.
+	lastActive int64
+	received   int64
+
+	Request  *BlockedBuffer
+	Response *StreamBuffer
+	// Window is the send window of request data.
+	Window *Window
+	// Packets receives the datagrams of a udp tunnel instead of Response,
+	// it is nil for stream tunnels. Each Write of a udp tunnel is sent as a
+	// datagram.
+	Packets *PacketBuffer
+
+	TID string
+	// Route is the route record used to create the transferer.
+	Route RouteRecord
+
+	// agent is the agent serving the transfer, and clientAddr is the
+	// address of its client, they are only used by broker.
+	agent      *Agent
+	clientAddr string
+	// onAbort tells the agent the transfer is aborted, it is called by
+	// Close after CloseWrite since the request can not carry it anymore.
+	onAbort func()
 }
 
-func NewTransferer() Transferer {
-	return Transferer{
+// NewTransferer creates a transferer, onConsume is called when response data
+// is consumed, see StreamBuffer.
+func NewTransferer(onConsume func(n int)) *Transferer {
+	return &Transferer{
 		Request:  NewBlockedBuffer(),
-		Response: NewBlockedBuffer(),
+		Response: NewStreamBuffer(onConsume),
+		Window:   NewWindow(InitialWindowSize),
+	}
+}
+
+func (t *Transferer) Read(p []byte) (n int, err error) {
+	return t.Response.Read(p)
+}
+
+func (t *Transferer) Write(p []byte) (n int, err error) {
+	t.touch()
+	return t.Request.Write(p)
+}
+
+// CloseWrite finishes the request, the response can still be read.
+func (t *Transferer) CloseWrite() error {
+	return t.Request.Close()
+}
+
+// Close aborts the transfer unless both the request and response are
+// finished.
+func (t *Transferer) Close() error {
+	t.abort(io.ErrClosedPipe)
+	return nil
+}
+
+// abort is like SetError, but the agent is also told if the request is
+// already finished.
+func (t *Transferer) abort(err error) {
+	respErr := t.Response.SetError(err)
+	t.Window.SetError(err)
+	if t.Packets != nil {
+		t.Packets.SetError(err)
+	}
+	reqErr := t.Request.SetError(err)
+	if reqErr == io.EOF && respErr == nil && t.onAbort != nil {
+		t.onAbort()
+	}
+}
+
+// ReadPacket reads a datagram of a udp tunnel.
+func (t *Transferer) ReadPacket() ([]byte, error) {
+	return t.Packets.Read()
+}
+
+// SetError aborts the transfer with err.
+func (t *Transferer) SetError(err error) {
+	t.Request.SetError(err)
+	t.Response.SetError(err)
+	t.Window.SetError(err)
+	if t.Packets != nil {
+		t.Packets.SetError(err)
+	}
+}
+
+// receive writes the data sent by the agent.
+func (t *Transferer) receive(p []byte) (err error) {
+	t.touch()
+	atomic.AddInt64(&t.received, int64(len(p)))
+	if t.Packets != nil {
+		_, err = t.Packets.Write(p)
+	} else {
+		_, err = t.Response.Write(p)
+	}
+	return
+}
+
+// finish is called when the agent finishes the transfer, err is io.EOF if
+// it is finished normally. The local connection is closed by the agent, so
+// the rest of the request is not sent.
+func (t *Transferer) finish(err error) {
+	t.Request.SetError(err)
+	t.Window.SetError(err)
+	if t.Packets != nil {
+		t.Packets.SetError(err)
 	}
+	t.Response.SetError(err)
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packetQueueSize is the number of datagrams buffered by a PacketBuffer.
+const packetQueueSize = 256
+
+// maxPacketSize is the maximum size of a udp datagram.
+const maxPacketSize = 64 * 1024
+
+// DefaultUDPIdleTimeout is used if Broker.UDPIdleTimeout is 0.
+const DefaultUDPIdleTimeout = time.Minute
+
+// PacketBuffer is the receiving buffer of datagrams. Like udp, Write never
+// blocks and datagrams are dropped when the buffer is full.
+type PacketBuffer struct {
+	cond    *sync.Cond
+	packets [][]byte
+	size    int
+	err     error
+}
+
+func NewPacketBuffer(size int) *PacketBuffer {
+	return &PacketBuffer{
+		cond: sync.NewCond(new(sync.Mutex)),
+		size: size,
+	}
+}
+
+// Write queues the datagram p, p must not be modified after Write. Datagrams
+// larger than maxPacketSize are dropped.
+func (b *PacketBuffer) Write(p []byte) (n int, err error) {
+	b.cond.L.Lock()
+	if err = b.err; err == nil && len(b.packets) < b.size && len(p) <= maxPacketSize {
+		b.packets = append(b.packets, p)
+		n = len(p)
+	}
+	b.cond.L.Unlock()
+	b.cond.Signal()
+	return
+}
+
+// Read returns a datagram, it blocks until a datagram is available or an
+// error is set.
+func (b *PacketBuffer) Read() (p []byte, err error) {
+	b.cond.L.Lock()
+	for b.err == nil && len(b.packets) == 0 {
+		b.cond.Wait()
+	}
+	if len(b.packets) > 0 {
+		p, b.packets = b.packets[0], b.packets[1:]
+	} else {
+		err = b.err
+	}
+	b.cond.L.Unlock()
+	return
+}
+
+// SetError makes Read return err after the queued datagrams are read.
+func (b *PacketBuffer) SetError(e error) (err error) {
+	b.cond.L.Lock()
+	if err = b.err; err == nil {
+		b.err = e
+	}
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+	return
+}
+
+// splitNetwork splits the network from an upstream address, an address
+// prefixed with "udp://" is a udp address, others are tcp addresses.
+func splitNetwork(host string) (network, addr string) {
+	if strings.HasPrefix(host, "udp://") {
+		return "udp", host[len("udp://"):]
+	}
+	return "tcp", host
+}
+
+// forwardPackets dispatches each write to tf as a DataMessage. Unlike
+// forwardRequest, datagrams are not limited by the window, they are dropped
+// if the agent connection is congested. A BlockedBuffer is consumed before
+// the next write, so a read returns exactly one write.
+func (b *Broker) forwardPackets(agent *Agent, host string, tf *Transferer) {
+	dispatch := func(msg Transferable) {
+		b.ev.DispatchRequest <- BEvDispatchMessage{Agent: agent, Msg: msg}
+	}
+	dispatch(FirstDataMessage{DataMessage: DataMessage{TID: tf.TID}, Host: host, ClientAddr: tf.clientAddr})
+
+	var err error
+	buf := make([]byte, maxPacketSize)
+	for {
+		var n int
+		if n, err = tf.Request.Read(buf); err != nil {
+			break
+		}
+		b.ev.DispatchRequest <- BEvDispatchMessage{
+			Agent:  agent,
+			Msg:    DataMessage{TID: tf.TID, Data: append([]byte(nil), buf[:n]...)},
+			Packet: true,
+		}
+	}
+	dispatch(LastDataMessage{DataMessage: DataMessage{TID: tf.TID}, Err: errString(err)})
+}
+
+type udpSession struct {
+	tf *Transferer
+	// lastActive is the unix nano time of the last datagram
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&s.lastActive))
+}
+
+// serveUDP forwards the datagrams received by pc to agents of route. Each
+// client address has a session which is a transferer, sessions are closed
+// after they are idle for UDPIdleTimeout.
+func (b *Broker) serveUDP(pc net.PacketConn, route RouteRecord) {
+	timeout := b.UDPIdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultUDPIdleTimeout
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	remove := func(addr string, s *udpSession) {
+		mu.Lock()
+		if sessions[addr] == s {
+			delete(sessions, addr)
+		}
+		mu.Unlock()
+		s.tf.Close()
+	}
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		mu.Lock()
+		for _, s := range sessions {
+			s.tf.Close()
+		}
+		mu.Unlock()
+	}()
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			for addr, s := range sessions {
+				if s.idle() >= timeout {
+					log.Debugf("udp session %s of %s expired", addr, route.Key)
+					delete(sessions, addr)
+					s.tf.Close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		mu.Lock()
+		s := sessions[key]
+		mu.Unlock()
+		if s == nil {
+			tf, err := b.CreatePacketTunnel(route, key)
+			if err != nil {
+				log.Debugf("udp tunnel %s from %s: %s", route.Key, key, err)
+				continue
+			}
+			s = &udpSession{tf: tf}
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+			go func() {
+				b.relayPackets(pc, addr, s)
+				remove(key, s)
+			}()
+		}
+		s.touch()
+		if _, err := s.tf.Write(buf[:n]); err != nil {
+			remove(key, s)
+		}
+	}
+}
+
+// relayPackets sends the datagrams from the agent back to the client addr.
+func (b *Broker) relayPackets(pc net.PacketConn, addr net.Addr, s *udpSession) {
+	for {
+		p, err := s.tf.ReadPacket()
+		if err != nil {
+			return
+		}
+		s.touch()
+		if _, err := pc.WriteTo(p, addr); err != nil {
+			return
+		}
+	}
+}
+
+// readLocalPackets sends each datagram read from the local udp connection as
+// a DataMessage.
+func (a *Agent) readLocalPackets(lc *localConn, tid, host string) {
+	var err error
+	buf := make([]byte, maxPacketSize)
+	for {
+		var n int
+		if n, err = lc.Read(buf); err != nil {
+			break
+		}
+		if err = a.SendPacket(DataMessage{TID: tid, Data: buf[:n]}); err != nil {
+			break
+		}
+	}
+	a.sendLastDataMessage(tid, err)
+
+	select {
+	case a.ev.CloseLocalConn <- AE_CloseLocalConn{TID: tid, Host: host, Err: err}:
+	case <-a.done:
+	}
+}
+
+// writeLocalPackets writes each datagram from broker to the local udp
+// connection.
+func (a *Agent) writeLocalPackets(lc *localConn) {
+	for {
+		p, err := lc.packets.Read()
+		if err != nil {
+			return
+		}
+		if _, err = lc.Write(p); err != nil {
+			log.Debugf("write datagram to local connection: %s", err)
+		}
+	}
+}
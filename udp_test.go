@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketBuffer(t *testing.T) {
+	assert := assert.New(t)
+	b := NewPacketBuffer(2)
+	b.Write([]byte("a"))
+	b.Write([]byte("bc"))
+	n, err := b.Write([]byte("dropped"))
+	assert.Equal(0, n)
+	assert.Nil(err)
+
+	b.SetError(io.EOF)
+	p, _ := b.Read()
+	assert.Equal("a", string(p))
+	p, _ = b.Read()
+	assert.Equal("bc", string(p))
+	_, err = b.Read()
+	assert.Equal(io.EOF, err)
+
+	n, _ = NewPacketBuffer(2).Write(make([]byte, maxPacketSize+1))
+	assert.Equal(0, n)
+}
+
+func TestUDPTunnel(t *testing.T) {
+	assert := assert.New(t)
+	// the server replies each datagram with the address of the sender, so
+	// a new session can be told by a new address
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo([]byte(addr.String()+" "+string(buf[:n])), addr)
+		}
+	}()
+
+	tunnel, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Broker{Token: "test-token", UDPIdleTimeout: time.Millisecond * 200}
+	b.Init()
+	b.route = Route{"test.host": {AgentIDs: []string{"test-agent"}, Host: "127.0.0.1:1"}}
+	b.udpTunnels = map[net.PacketConn]RouteRecord{
+		tunnel: {AgentIDs: []string{"test-agent"}, Host: server.LocalAddr().String(), Key: "udp test"},
+	}
+	addr, stop := serveTestBroker(t, b)
+	defer stop()
+	go NewAgent("test-agent").Connect(addr, "test-token")
+	waitRoute(t, b, "test.host")
+
+	conn, err := net.Dial("udp", tunnel.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange := func(data string) (from, reply string) {
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte(data))
+		buf := make([]byte, maxPacketSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp := strings.SplitN(string(buf[:n]), " ", 2)
+		return sp[0], sp[1]
+	}
+
+	// datagrams keep their boundaries
+	session, reply := exchange("hello")
+	assert.Equal("hello", reply)
+	big := strings.Repeat("x", 60000)
+	from, reply := exchange(big)
+	assert.Equal(session, from)
+	assert.Equal(big, reply)
+
+	// a new session is created after the old one expires
+	time.Sleep(time.Millisecond * 500)
+	from, reply = exchange("again")
+	assert.NotEqual(session, from)
+	assert.Equal("again", reply)
+}